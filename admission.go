@@ -0,0 +1,189 @@
+package sylph
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrTooManyTransports is reported when the Server has ServerConfig.MaxTransports Transports.
+	ErrTooManyTransports = errors.New("too many transports")
+	// ErrTooManyHandshakes is reported when ServerConfig.MaxPendingHandshakes handshakes are in progress.
+	ErrTooManyHandshakes = errors.New("too many pending handshakes")
+	// ErrHandshakeRateLimited is reported when the source IP exceeded ServerConfig.HandshakeRateLimit.
+	ErrHandshakeRateLimited = errors.New("handshake rate limit exceeded")
+	// ErrConnectionRateLimited is reported when the source IP exceeded ServerConfig.ConnectionRateLimit.
+	ErrConnectionRateLimited = errors.New("connection rate limit exceeded")
+)
+
+const defaultRateLimitInterval = time.Second
+
+// rateLimiter limits events per source IP with token buckets.
+type rateLimiter struct {
+	burst    float64
+	interval time.Duration
+	lock     sync.Mutex
+	buckets  map[string]*bucket
+	pruned   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns nil when RateLimit is disabled.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Burst <= 0 {
+		return nil
+	}
+	interval := limit.Interval
+	if interval <= 0 {
+		interval = defaultRateLimitInterval
+	}
+	return &rateLimiter{
+		burst:    float64(limit.Burst),
+		interval: interval,
+		buckets:  map[string]*bucket{},
+		pruned:   time.Now(),
+	}
+}
+
+// allow reports whether an event from the address is allowed, and consumes a token when allowed.
+func (l *rateLimiter) allow(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+
+	now := time.Now()
+	key := sourceIP(addr)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.prune(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (l *rateLimiter) refill(b *bucket, now time.Time) {
+	b.tokens += float64(now.Sub(b.updated)) / float64(l.interval)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.updated = now
+}
+
+// prune removes full buckets, which are same as no bucket.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.interval*time.Duration(l.burst) {
+		return
+	}
+	l.pruned = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func sourceIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// admitHandshake is called by the listener before dtls handshake.
+// A Transport is reserved for the connection until the handshake failed,
+// or the Transport is registered or closed. See releaseTransport.
+func (s *Server) admitHandshake(remoteAddr net.Addr) (func(established bool), error) {
+	if !s.reserveTransport() {
+		return nil, s.reject(remoteAddr, ErrTooManyTransports)
+	}
+	if !s.reserveHandshake() {
+		s.releaseTransport()
+		return nil, s.reject(remoteAddr, ErrTooManyHandshakes)
+	}
+	if !s.handshakeLimiter.allow(remoteAddr) {
+		atomic.AddInt32(&s.pendingHandshakes, -1)
+		s.releaseTransport()
+		return nil, s.reject(remoteAddr, ErrHandshakeRateLimited)
+	}
+
+	return func(established bool) {
+		atomic.AddInt32(&s.pendingHandshakes, -1)
+		if !established {
+			s.releaseTransport()
+		}
+	}, nil
+}
+
+// reserveHandshake counts a dtls handshake in progress, which is refused over MaxPendingHandshakes.
+func (s *Server) reserveHandshake() bool {
+	max := int32(s.config.MaxPendingHandshakes)
+	for {
+		pending := atomic.LoadInt32(&s.pendingHandshakes)
+		if max > 0 && pending >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.pendingHandshakes, pending, pending+1) {
+			return true
+		}
+	}
+}
+
+// reserveTransport counts a Transport in connecting, which is refused over MaxTransports
+// together with registered Transports.
+func (s *Server) reserveTransport() bool {
+	max := s.config.MaxTransports
+	for {
+		pending := atomic.LoadInt32(&s.pendingTransports)
+		if max > 0 && s.transports.count()+int(pending) >= max {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.pendingTransports, pending, pending+1) {
+			return true
+		}
+	}
+}
+
+// releaseTransport releases the reservation of reserveTransport.
+// This is called when connecting failed, or after the Transport is registered.
+func (s *Server) releaseTransport() {
+	atomic.AddInt32(&s.pendingTransports, -1)
+}
+
+// admitConnection is called after dtls handshake, before creating the Transport.
+// The reservation of the connection is released when refused.
+func (s *Server) admitConnection(remoteAddr net.Addr) error {
+	if !s.connectionLimiter.allow(remoteAddr) {
+		s.releaseTransport()
+		return s.reject(remoteAddr, ErrConnectionRateLimited)
+	}
+	return nil
+}
+
+func (s *Server) reject(remoteAddr net.Addr, err error) error {
+	if s.onRejectHandler != nil {
+		s.onRejectHandler(remoteAddr, err)
+	}
+	return err
+}
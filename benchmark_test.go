@@ -0,0 +1,94 @@
+//go:build !windows
+// +build !windows
+
+package sylph_test
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tkmn0/sylph/internal/engine"
+	"github.com/tkmn0/sylph/internal/transport"
+)
+
+// BenchmarkIdleTransports measures memory, goroutines and CPU time of idle transports,
+// connected over in-memory pipes without dtls. Run with -benchtime 10000x for 10k transports.
+// Each transport has the pair of Server and Client side.
+func BenchmarkIdleTransports(b *testing.B) {
+	config := engine.EngineConfig{
+		HeartbeatRateMillisec:   testTransportConfig.HeartbeatRateMillisec,
+		TimeOutDurationMilliSec: testTransportConfig.TimeOutDurationMilliSec,
+	}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	goroutines := runtime.NumGoroutine()
+
+	transports := []*transport.SctpTransport{}
+	defer func() {
+		for _, t := range transports {
+			t.Close()
+		}
+	}()
+	for i := 0; i < b.N; i++ {
+		client, server, err := newTransportPair(config)
+		if err != nil {
+			b.Fatal(err)
+		}
+		transports = append(transports, client, server)
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.HeapInuse-before.HeapInuse)/float64(b.N), "heap-B/transport")
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines)/float64(b.N), "goroutines/transport")
+
+	// CPU time while the transports only send heartbeat.
+	idle := time.Second * 3
+	start := cpuTime(b)
+	time.Sleep(idle)
+	b.ReportMetric(float64(cpuTime(b)-start)/idle.Seconds()/float64(b.N), "cpu-ns/transport/s")
+}
+
+// newTransportPair connects transports of Client and Server side over net.Pipe.
+func newTransportPair(config engine.EngineConfig) (*transport.SctpTransport, *transport.SctpTransport, error) {
+	clientConn, serverConn := net.Pipe()
+	server := transport.NewSctpTransport("server")
+	initialized := make(chan struct{})
+	server.OnTransportInitialized = func() {
+		close(initialized)
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		err := server.Init(serverConn, false, config)
+		serverErr <- err
+		if err == nil {
+			server.AcceptStreamLoop()
+		}
+	}()
+
+	client := transport.NewSctpTransport("")
+	if err := client.Init(clientConn, true, config); err != nil {
+		return nil, nil, err
+	}
+	if err := <-serverErr; err != nil {
+		return nil, nil, err
+	}
+	<-initialized
+	return client, server, nil
+}
+
+// cpuTime returns user and system CPU time of the process.
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
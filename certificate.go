@@ -0,0 +1,99 @@
+package sylph
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"time"
+)
+
+// ErrCertificateMismatch is reported when the server certificate does not match the pinned fingerprint.
+var ErrCertificateMismatch = errors.New("certificate fingerprint mismatch")
+
+// CertificateError is reported when Client rejects the server certificate.
+type CertificateError struct {
+	Err error
+}
+
+func (e *CertificateError) Error() string {
+	return "certificate verification failed: " + e.Err.Error()
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// Fingerprint returns SHA-256 fingerprint of the leaf certificate.
+// The value can be used as TransportConfig.CertificateFingerprint.
+func Fingerprint(certificate tls.Certificate) []byte {
+	if len(certificate.Certificate) == 0 {
+		return nil
+	}
+	sum := sha256.Sum256(certificate.Certificate[0])
+	return sum[:]
+}
+
+// certificateVerifier verifies server certificates with TransportConfig.
+type certificateVerifier struct {
+	rootCAs     *x509.CertPool
+	serverName  string
+	fingerprint []byte
+}
+
+// newCertificateVerifier returns nil when TransportConfig requires no verification.
+func newCertificateVerifier(tc TransportConfig) *certificateVerifier {
+	if tc.RootCAs == nil && tc.ServerName == "" && len(tc.CertificateFingerprint) == 0 {
+		return nil
+	}
+	return &certificateVerifier{
+		rootCAs:     tc.RootCAs,
+		serverName:  tc.ServerName,
+		fingerprint: tc.CertificateFingerprint,
+	}
+}
+
+func (v *certificateVerifier) verify(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return &CertificateError{Err: errors.New("no certificate received")}
+	}
+
+	if v.rootCAs != nil || v.serverName != "" {
+		if err := v.verifyChain(rawCerts); err != nil {
+			return &CertificateError{Err: err}
+		}
+	}
+
+	if len(v.fingerprint) != 0 {
+		sum := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(sum[:], v.fingerprint) {
+			return &CertificateError{Err: ErrCertificateMismatch}
+		}
+	}
+	return nil
+}
+
+func (v *certificateVerifier) verifyChain(rawCerts [][]byte) error {
+	certificates := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, certificate)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, certificate := range certificates[1:] {
+		intermediates.AddCert(certificate)
+	}
+
+	_, err := certificates[0].Verify(x509.VerifyOptions{
+		Roots:         v.rootCAs,
+		CurrentTime:   time.Now(),
+		DNSName:       v.serverName,
+		Intermediates: intermediates,
+	})
+	return err
+}
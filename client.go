@@ -4,14 +4,22 @@ package sylph
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pion/dtls/v2"
 	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
 	"github.com/tkmn0/sylph/internal/engine"
+	"github.com/tkmn0/sylph/internal/mux"
 	"github.com/tkmn0/sylph/internal/transport"
+	"github.com/tkmn0/sylph/pkg/channel"
+	"github.com/tkmn0/sylph/pkg/util"
 )
 
 type ConnectionState int
@@ -23,6 +31,10 @@ const (
 	TimeOut
 	ErrorToReady
 	Connected
+	AuthFailed
+	Rejected
+	Reconnecting
+	Reconnected
 )
 
 func (s ConnectionState) String() string {
@@ -39,20 +51,67 @@ func (s ConnectionState) String() string {
 		return "ErrorToReady"
 	case Connected:
 		return "Connected"
+	case AuthFailed:
+		return "AuthFailed"
+	case Rejected:
+		return "Rejected"
+	case Reconnecting:
+		return "Reconnecting"
+	case Reconnected:
+		return "Reconnected"
 	}
 	return ""
 }
 
+// RejectedError is reported when Server rejected the transport in OnAuthenticate.
+// Reason is the error message returned by the OnAuthenticate handler.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return "transport rejected: " + e.Reason
+}
+
+var (
+	// ErrHandshakeTimeout is reported when connecting did not complete within TransportConfig.HandshakeTimeout.
+	ErrHandshakeTimeout = errors.New("handshake timed out")
+	// ErrConnectionRefused is reported when Server is not listening on the address.
+	ErrConnectionRefused = errors.New("connection refused")
+)
+
+// AssociationError is reported when sctp association over the dtls connection failed.
+type AssociationError struct {
+	Err error
+}
+
+func (e *AssociationError) Error() string {
+	return "sctp association failed: " + e.Err.Error()
+}
+
+func (e *AssociationError) Unwrap() error {
+	return e.Err
+}
+
 // Client handles base connections. (udp, dtls, sctp)
 // The relationship Client and Transport is one to one.
 type Client struct {
-	addr                     *net.UDPAddr
+	host                     string
+	port                     int
+	config                   TransportConfig
 	cancel                   context.CancelFunc
 	onTransportHandler       func(t Transport)
 	onConnectionStateChanged func(state ConnectionState)
+	lock                     sync.RWMutex
 	transports               map[string]Transport
 	conn                     *dtls.Conn
 	connectionState          ConnectionState
+	err                      error
+	closeCh                  chan struct{}
+	closed                   bool
+	packetConn               net.PacketConn
+	fallback                 func(packet []byte, addr net.Addr)
+	mux                      *mux.PacketMux
 }
 
 // NewClient creates a new Client
@@ -62,60 +121,345 @@ func NewClient() *Client {
 	}
 }
 
+// NewClientWithPacketConn creates a new Client sending and receiving packets with conn
+// instead of its own udp socket.
+// conn is not closed by Client, and packets other than dtls records of Server are passed to
+// the handler of SetFallback. Client uses the read deadline of conn to stop reading it, and clears the
+// deadline after the connection closed. Do not set the read deadline while Client uses conn.
+func NewClientWithPacketConn(conn net.PacketConn) *Client {
+	c := NewClient()
+	c.packetConn = conn
+	return c
+}
+
+// SetFallback sets the handler for packets read from the PacketConn of NewClientWithPacketConn,
+// which are not dtls records of Server, e.g. STUN. Without the handler, they are dropped.
+// Set this before connecting. packet is owned by the handler.
+func (c *Client) SetFallback(handler func(packet []byte, addr net.Addr)) {
+	c.fallback = handler
+}
+
 // Connect tries to connect with sylph Server.
+// address can be a name, an IPv4 address or an IPv6 address.
 // After connection established, OnTransport will be called.
+// When TransportConfig.Reconnect is set, Client reconnects after the Transport is lost,
+// and the Transport passed to OnTransport keeps working with reopened channels.
 func (c *Client) Connect(address string, port int, tc TransportConfig) {
-	// Prepare the IP to connect to
-	addr := &net.UDPAddr{IP: net.ParseIP(address), Port: port}
+	c.ConnectContext(context.Background(), net.JoinHostPort(address, strconv.Itoa(port)), tc)
+}
 
-	// Generate a certificate and private key to secure the connection
-	certificate, genErr := selfsign.GenerateSelfSigned()
+// ConnectContext connects with sylph Server at addr ("host:port"), and returns the Transport.
+// The host can be a name, and its addresses are tried in order. IPv6 address is written as "[::1]:port".
+// Each address is given an equal share of the time left, so that an unreachable address
+// does not use up TransportConfig.HandshakeTimeout.
+// OnTransport is called before this returns as well as Connect.
+// Connecting is stopped when ctx is done, or TransportConfig.HandshakeTimeout elapsed.
+// The returned error is ErrHandshakeTimeout, ErrConnectionRefused, *CertificateError,
+// *AssociationError or *RejectedError wrapped, or the error of ctx.
+// Server negotiates the protocol version with Client. With Server of releases without protocol version,
+// Client uses version 0, where a message is limited to 1023 bytes.
+func (c *Client) ConnectContext(ctx context.Context, addr string, tc TransportConfig) (Transport, error) {
+	c.lock.Lock()
+	c.config = tc
+	c.closeCh = make(chan struct{})
+	c.closed = false
+	c.connectionState = Calling
+	c.lock.Unlock()
 
-	if genErr != nil {
-		c.connectionState = ErrorToReady
-		if c.onConnectionStateChanged != nil {
-			c.onConnectionStateChanged(c.connectionState)
+	host, port, err := util.SplitHostPort(addr)
+	if err != nil {
+		c.setConnectionState(ErrorToReady, err)
+		return nil, err
+	}
+	c.lock.Lock()
+	c.host = host
+	c.port = port
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, tc.handshakeTimeout())
+	defer cancel()
+
+	dtlsConn, state, err := c.dial(ctx, cancel)
+	c.setConnectionState(state, err)
+	if err != nil {
+		return nil, err
+	}
+
+	ct := newSessionTransport()
+	ready := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			select {
+			case <-stop:
+				// connected
+			default:
+				// sctp association and the transport handshake have no timeout.
+				dtlsConn.Close()
+			}
+		case <-stop:
 		}
-		return
+	}()
+
+	if err := c.startTransport(dtlsConn, ct, nil, ready); err != nil {
+		dtlsConn.Close()
+		err = c.connectError(ctx, &AssociationError{Err: err})
+		c.setConnectionState(TimeOut, err)
+		return nil, err
 	}
 
-	// Prepare the configuration of the DTLS connection
-	config := &dtls.Config{
-		Certificates:         []tls.Certificate{certificate},
-		InsecureSkipVerify:   true,
-		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	select {
+	case err := <-ready:
+		if err != nil {
+			return nil, err
+		}
+		return ct, nil
+	case <-ctx.Done():
+		err := c.connectError(ctx, ctx.Err())
+		c.setConnectionState(TimeOut, err)
+		return nil, err
 	}
+}
 
-	// Connect to a DTLS server
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+// dial connects to Server with dtls.
+// The returned ConnectionState is the result of dialing.
+// cancel is called by Close while dialing.
+func (c *Client) dial(ctx context.Context, cancel context.CancelFunc) (*dtls.Conn, ConnectionState, error) {
+	tc, host, port := c.target()
+	config, err := c.dtlsConfig(tc)
+	if err != nil {
+		return nil, ErrorToReady, err
+	}
+
+	c.lock.Lock()
 	c.cancel = cancel
-	c.connectionState = Calling
+	c.lock.Unlock()
+	addrs, err := util.ResolveUDPAddrs(ctx, host, port)
+	if err != nil {
+		return nil, ErrorToReady, err
+	}
 
-	dtlsConn, err := dtls.DialWithContext(ctx, "udp", addr, config)
+	// Connect to a DTLS server, trying resolved addresses in order.
+	for i, addr := range addrs {
+		addrCtx, cancelAddr := addressContext(ctx, len(addrs)-i)
+		var dtlsConn *dtls.Conn
+		dtlsConn, err = c.dialDTLS(addrCtx, addr, config)
+		if err == nil {
+			cancelAddr()
+			return dtlsConn, Connected, nil
+		}
 
-	if err != nil {
-		c.connectionState = TimeOut
-		if c.onConnectionStateChanged != nil {
-			c.onConnectionStateChanged(c.connectionState)
+		var certificateError *CertificateError
+		if errors.As(err, &certificateError) {
+			cancelAddr()
+			return nil, AuthFailed, err
 		}
-		return
+		err = c.connectError(addrCtx, err)
+		cancelAddr()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if errors.Is(err, context.Canceled) {
+		return nil, Canceled, err
 	}
+	return nil, TimeOut, err
+}
+
+// addressContext returns ctx for dialing one of remaining addresses,
+// which shares the time left before the deadline of ctx equally with the others.
+func addressContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || remaining <= 1 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+}
 
-	c.connectionState = Connected
+// dialDTLS connects to addr with dtls, over the PacketConn when given.
+func (c *Client) dialDTLS(ctx context.Context, addr *net.UDPAddr, config *dtls.Config) (*dtls.Conn, error) {
+	if c.packetConn == nil {
+		return dtls.DialWithContext(ctx, "udp", addr, config)
+	}
+
+	c.lock.Lock()
+	if c.mux == nil || c.mux.IsClosed() {
+		c.mux = mux.NewPacketMux(c.packetConn, nil, c.fallback, false)
+	}
+	m := c.mux
+	c.lock.Unlock()
+	conn, err := m.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	dtlsConn, err := dtls.ClientWithContext(ctx, conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return dtlsConn, nil
+}
+
+// target returns TransportConfig, host and port given to ConnectContext.
+func (c *Client) target() (TransportConfig, string, int) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.config, c.host, c.port
+}
+
+// connectError classifies err occurred while connecting with ctx.
+func (c *Client) connectError(ctx context.Context, err error) error {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %v", ErrConnectionRefused, err)
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return context.Canceled
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", ErrHandshakeTimeout, err)
+	}
+	return err
+}
+
+// startTransport starts sctp on the dtls connection, and attaches it to sessionTransport.
+// channelConfigs is not nil when reconnected, channels are reopened instead of calling OnTransport.
+// ready receives the result of the transport handshake when it is not nil.
+func (c *Client) startTransport(dtlsConn *dtls.Conn, ct *sessionTransport, channelConfigs []channel.ChannelConfig, ready chan<- error) error {
+	c.lock.Lock()
 	c.conn = dtlsConn
+	tc := c.config
+	c.lock.Unlock()
+
+	id := ""
+	if tc.DCEP {
+		// DCEP peers send no transport id, and it is made by this side.
+		uuidObj, err := uuid.NewRandom()
+		if err != nil {
+			return err
+		}
+		id = uuidObj.String() + "-client"
+	}
+	t := transport.NewSctpTransport(id)
+	t.AuthPayload = tc.AuthPayload
+	t.DCEP = tc.DCEP
+	if previous := ct.transport(); previous != nil {
+		// Server resumes the previous transport with the token when resumption is enabled.
+		t.SetResumptionToken(previous.ResumptionToken())
+	}
+	t.OnTransportInitialized = func() {
+		c.lock.Lock()
+		c.transports[t.Id()] = ct
+		c.lock.Unlock()
+		// channels opened by Server are accepted after OnTransport, so that OnChannel is ready for them.
+		defer func() {
+			go t.AcceptStreamLoop()
+		}()
+		if channelConfigs == nil {
+			if c.onTransportHandler != nil {
+				c.onTransportHandler(ct)
+			}
+			if ready != nil {
+				ready <- nil
+			}
+			return
+		}
 
-	t := transport.NewSctpTransport("")
-	t.Init(dtlsConn, true, engine.EngineConfig{
+		t.ReopenChannels(channelConfigs)
+		ct.setSuspended(false)
+		c.setConnectionState(Reconnected, nil)
+	}
+	t.OnTransportRejected = func(reason string) {
+		err := &RejectedError{Reason: reason}
+		ct.setSuspended(false)
+		c.setConnectionState(Rejected, err)
+		c.Close()
+		if ready != nil {
+			ready <- err
+		}
+	}
+	t.OnTransportGoingAway = func() {
+		// Server is shutting down, reconnecting will not help.
+		ct.Close()
+	}
+	t.OnTransportLost = func(err error) {
+		if tc.Reconnect == nil {
+			return
+		}
+		// the transport lost in connecting is not registered, ConnectContext reports the error.
+		c.lock.Lock()
+		_, registered := c.transports[t.Id()]
+		if c.closed || !registered {
+			c.lock.Unlock()
+			return
+		}
+		delete(c.transports, t.Id())
+		c.lock.Unlock()
+
+		ct.setSuspended(true)
+		go c.reconnect(ct, t.ChannelConfigs())
+	}
+	ct.attach(t)
+	return t.Init(dtlsConn, true, engine.EngineConfig{
 		HeartbeatRateMillisec:   tc.HeartbeatRateMillisec,
 		TimeOutDurationMilliSec: tc.TimeOutDurationMilliSec,
+		MaxMessageSize:          tc.MaxMessageSize,
 	})
-	t.OnTransportInitialized = func() {
-		c.onTransportHandler(t)
-	}
-	c.transports[t.Id()] = t
+}
+
+// setConnectionState updates ConnectionState with the reason, and notifies it.
+func (c *Client) setConnectionState(state ConnectionState, err error) {
+	c.lock.Lock()
+	c.connectionState = state
+	c.err = err
+	c.lock.Unlock()
 	if c.onConnectionStateChanged != nil {
-		c.onConnectionStateChanged(c.connectionState)
+		c.onConnectionStateChanged(state)
+	}
+}
+
+// dtlsConfig prepares the configuration of the DTLS connection.
+func (c *Client) dtlsConfig(tc TransportConfig) (*dtls.Config, error) {
+	config := &dtls.Config{
+		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+	}
+
+	if tc.PSK != nil {
+		// Certificates are not used with PSK cipher suites.
+		config.PSK = func(hint []byte) ([]byte, error) {
+			return tc.PSK, nil
+		}
+		config.PSKIdentityHint = tc.PSKIdentityHint
+		config.CipherSuites = util.PSKCipherSuites()
+		return config, nil
+	}
+
+	certificate, err := c.certificate(tc)
+	if err != nil {
+		return nil, err
 	}
+	config.Certificates = []tls.Certificate{certificate}
+
+	// Server certificate is verified by certificateVerifier instead of dtls,
+	// so that verification failures can be told apart from other dial errors.
+	config.InsecureSkipVerify = true
+	config.ServerName = tc.ServerName
+	if verifier := newCertificateVerifier(tc); verifier != nil {
+		config.VerifyPeerCertificate = verifier.verify
+	}
+	return config, nil
+}
+
+// certificate returns the certificate presented to Server.
+func (c *Client) certificate(tc TransportConfig) (tls.Certificate, error) {
+	if tc.Certificate != nil {
+		return *tc.Certificate, nil
+	}
+
+	// Generate a certificate and private key to secure the connection
+	return selfsign.GenerateSelfSigned()
 }
 
 func (c *Client) ConnectAsync(address string, port int, tc TransportConfig) {
@@ -123,11 +467,25 @@ func (c *Client) ConnectAsync(address string, port int, tc TransportConfig) {
 }
 
 func (c *Client) ConnectionState() ConnectionState {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	return c.connectionState
 }
 
+// Err returns the reason of the current ConnectionState when connecting failed.
+// When the state is Rejected, the error is *RejectedError.
+// When the state is AuthFailed, the error wraps *CertificateError.
+// This can be called in OnConnectionStateChanged handler.
+func (c *Client) Err() error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.err
+}
+
 // Transport returns Transport corresponded with id
 func (c *Client) Transport(id string) Transport {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	if t, exists := c.transports[id]; exists && !t.IsClosed() {
 		return t
 	} else {
@@ -142,17 +500,31 @@ func (c *Client) OnTransport(handler func(t Transport)) {
 }
 
 // Close closes dtls connection.
+// Reconnection in progress is stopped.
 func (c *Client) Close() {
-	if c.connectionState == Calling && c.cancel != nil {
+	c.lock.Lock()
+	if (c.connectionState == Calling || c.connectionState == Reconnecting) && c.cancel != nil {
 		c.cancel()
 	}
 
-	if c.conn != nil {
-		err := c.conn.Close()
+	if c.closeCh != nil && !c.closed {
+		c.closed = true
+		close(c.closeCh)
+	}
+	conn, m := c.conn, c.mux
+	c.lock.Unlock()
+
+	if conn != nil {
+		err := conn.Close()
 		if err != nil {
 			fmt.Println("dtls closed:", err.Error())
 		}
 	}
+
+	if m != nil {
+		// stops reading the PacketConn after the connection closed.
+		m.Close()
+	}
 }
 
 func (c *Client) OnConnectionStateChanged(handler func(s ConnectionState)) {
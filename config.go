@@ -1,14 +1,169 @@
 package sylph
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
 	"time"
 )
 
 // TransportConfig is cofig for transport.
-// HeartbeatRateMillisec is rate for heart beat. Heartbeat sends 1 byte header.
+// HeartbeatRateMillisec is rate for heart beat. Heartbeat sends 5 bytes frame header.
 // Server and Client send heartbeat to detect the ohter side is running.
+// Client adopts HeartbeatRateMillisec and TimeOutDurationMilliSec of Server in the transport handshake.
+// Heartbeat is sent once per Transport on its base stream, not on Channels.
 // TimeOutDurationMillisec is time out duration to detect the other side is living.
+// The timeout closes the Transport and all of its Channels, and Transport.Err returns ErrHeartbeatTimeout.
+//
+// RootCAs, ServerName and CertificateFingerprint are used by Client to verify the server certificate.
+// When RootCAs or ServerName is set, the certificate chain is verified. (nil RootCAs uses the host's root CA set)
+// When CertificateFingerprint is set, SHA-256 fingerprint of the server certificate must match it.
+// When none of them is set, Client accepts any server certificate.
+// Certificate is presented by Client for client authentication. When nil, a self-signed certificate is generated.
+//
+// When PSK is set, Client uses pre-shared key cipher suites instead of certificates.
+// PSKIdentityHint is sent to Server as the identity of the key.
+//
+// AuthPayload is sent by Client to Server in the transport handshake, and passed to Server.OnAuthenticate.
+// It is sent in chunks when it is larger than a frame, and limited to 65535 bytes and MaxMessageSize of Server.
+//
+// Reconnect enables Client to reconnect when the Transport is lost, by heartbeat timeout or a failure
+// of the connection, not by Close of either side or Server going away. nil disables reconnection.
+//
+// HandshakeTimeout limits connecting of Client, including dtls handshake, sctp association
+// and the transport handshake. 0 uses 2 seconds. Server closes a connection which does not finish
+// dtls handshake, or sctp association and the transport handshake including OnAuthenticate, within it.
+//
+// DCEP opens Channels with Data Channel Establishment Protocol (RFC 8832) instead of the initialize message,
+// and Channels send messages without framing, as WebRTC data channels do. The transport handshake and heartbeat
+// of sylph are not run, so that the other side can be a WebRTC peer, and stream 0 is a Channel as well.
+// AuthPayload is not sent, Server calls OnAuthenticate with empty payload. The Transport is lost when
+// the association ends, not by heartbeat timeout. Server and Client must have the same DCEP,
+// otherwise the connection is closed by HandshakeTimeout of either side.
+//
+// MaxMessageSize limits the size of a message sent and received by Channels. 0 uses 1 MiB.
+// The smaller one of Server and Client is used by both sides.
+// Messages over 65535 bytes are sent in chunks, and sending over the limit returns MessageTooLargeError.
+// A received message over the limit fails the Channel with MessageTooLargeError passed to OnError,
+// and the Channel is closed on both sides. DCEP Channels send a message at once, up to 65535 bytes.
 type TransportConfig struct {
 	HeartbeatRateMillisec   time.Duration
 	TimeOutDurationMilliSec time.Duration
+	RootCAs                 *x509.CertPool
+	ServerName              string
+	CertificateFingerprint  []byte
+	Certificate             *tls.Certificate
+	PSK                     []byte
+	PSKIdentityHint         []byte
+	AuthPayload             []byte
+	Reconnect               *ReconnectPolicy
+	HandshakeTimeout        time.Duration
+	DCEP                    bool
+	MaxMessageSize          int
+}
+
+const defaultHandshakeTimeout = time.Second * 2
+
+func (tc TransportConfig) handshakeTimeout() time.Duration {
+	if tc.HandshakeTimeout <= 0 {
+		return defaultHandshakeTimeout
+	}
+	return tc.HandshakeTimeout
+}
+
+// NegotiatedConfig is config of a Transport negotiated in the transport handshake.
+// Server advertises its HeartbeatRateMillisec and TimeOutDurationMilliSec, and Client adopts them,
+// so that both sides expect heartbeat at the same rate.
+// MaxMessageSize is the smaller one of both sides.
+// Clients of releases without protocol version negotiate nothing, and Server keeps its own config.
+// Client keeps its own config with Servers of those releases, and ProtocolVersion is 0.
+type NegotiatedConfig struct {
+	HeartbeatRateMillisec   time.Duration
+	TimeOutDurationMilliSec time.Duration
+	MaxMessageSize          int
+	ProtocolVersion         uint8
+}
+
+// ReconnectPolicy is policy for reconnection of Client.
+// MaxAttempts is the maximum number of dialing, 0 means unlimited.
+// Backoff before each dialing starts from InitialBackoff and doubles up to MaxBackoff.
+// Jitter randomizes each backoff by the ratio, 0.2 spreads the backoff over ±20%.
+// Zero InitialBackoff and MaxBackoff use 500 milliseconds and 30 seconds.
+type ReconnectPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Jitter         float64
+}
+
+// ServerConfig is config for Server.
+// Certificate is presented to Clients in dtls handshake.
+// When Certificate is nil, it is loaded from PEM files of KeyPath and CertificatePath.
+// When none of them is set, Server generates a self-signed certificate on every Run.
+// ClientAuth is the policy for client certificates, and ClientCAs is used to verify them.
+// The default policy is tls.NoClientCert.
+//
+// When PSK is set, Server uses pre-shared key cipher suites instead of certificates.
+// PSK is called with the identity sent by Client and returns the key for it.
+// PSKIdentityHint is sent to Clients as a hint to choose the key.
+//
+// ResumptionGracePeriod enables transport resumption. 0 disables it.
+// Server keeps a lost Transport, by heartbeat timeout or a failure of the connection,
+// suspended for the period without calling OnClose.
+// A Client reconnecting with TransportConfig.Reconnect within the period reclaims the Transport,
+// keeping its id. Channels are not kept: both sides open theirs again on the resumed Transport,
+// and the new Channels are passed to OnChannel of both sides.
+//
+// MaxTransports, MaxPendingHandshakes, HandshakeRateLimit and ConnectionRateLimit refuse connections
+// to protect the Server, 0 means unlimited. Refused connections are reported to Server.OnReject.
+// MaxTransports is the maximum number of Transports, including connections in handshakes.
+// MaxPendingHandshakes is the maximum number of dtls handshakes in progress.
+// HandshakeRateLimit limits dtls handshakes and ConnectionRateLimit limits established connections,
+// per source IP address.
+//
+// ReusePortWorkers is the number of udp sockets opened for each address with SO_REUSEPORT,
+// each of which has its own dtls listener. The kernel distributes remote addresses to the sockets.
+// 0 or 1 opens a socket. This is supported only on Linux, and not used for ListenConfig.PacketConn.
+type ServerConfig struct {
+	Certificate           *tls.Certificate
+	KeyPath               string
+	CertificatePath       string
+	ClientAuth            tls.ClientAuthType
+	ClientCAs             *x509.CertPool
+	PSK                   func(identity []byte) ([]byte, error)
+	PSKIdentityHint       []byte
+	ResumptionGracePeriod time.Duration
+	MaxTransports         int
+	MaxPendingHandshakes  int
+	HandshakeRateLimit    RateLimit
+	ConnectionRateLimit   RateLimit
+	ReusePortWorkers      int
+}
+
+// ListenConfig is config for an address of Server.
+// Address and Port are same as Server.Run.
+// When any of Certificate, KeyPath and CertificatePath is set, they are used for the address
+// instead of ServerConfig.
+// When PacketConn is set, Server reads packets from it instead of listening on Address and Port.
+// PacketConn is not closed by Server. Server uses the read deadline of PacketConn to stop reading it,
+// and clears the deadline after closed. Do not set the read deadline while Server uses PacketConn.
+// Fallback is called with packets which are not dtls records of Clients, e.g. STUN,
+// and packets from addresses without a connection which do not start dtls handshake.
+// Without Fallback, they are dropped. packet is owned by Fallback.
+type ListenConfig struct {
+	Address         string
+	Port            int
+	Certificate     *tls.Certificate
+	KeyPath         string
+	CertificatePath string
+	PacketConn      net.PacketConn
+	Fallback        func(packet []byte, addr net.Addr)
+}
+
+// RateLimit limits events per source IP address.
+// Burst events are allowed at once, and one more event is allowed every Interval.
+// Zero Burst disables the limit, and zero Interval uses 1 second.
+type RateLimit struct {
+	Burst    int
+	Interval time.Duration
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"unsafe"
 
 	"github.com/tkmn0/sylph"
@@ -74,7 +75,13 @@ func OpenChannel(p unsafe.Pointer, config channel.ChannelConfig) {
 	if !exists {
 		return
 	}
-	t.OpenChannel(config)
+	go func() {
+		c, err := t.OpenChannel(context.Background(), config)
+		if err != nil {
+			return
+		}
+		callbackHandler.AddChannel(uintptr(p), c)
+	}()
 }
 
 func CloseTransport(p unsafe.Pointer) {
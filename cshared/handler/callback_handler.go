@@ -88,14 +88,24 @@ func (h *CallbackHandler) setupTransportEvents(transport *sylph.Transport) {
 	})
 
 	(*transport).OnChannel(func(channel channel.Channel) {
-		if h.onChannelHandler != nil {
-			h.onChannelHandler(channel, uintptr(unsafe.Pointer(&channel)))
-		}
-		h.setupChannelEvents(&channel)
-		onChannelQueue.Enqueue(uintptr(unsafe.Pointer(&channel)))
+		h.AddChannel(uintptr(unsafe.Pointer(transport)), channel)
 	})
 }
 
+// AddChannel notifies the channel of the transport, opened by either side.
+func (h *CallbackHandler) AddChannel(transportPtr uintptr, channel channel.Channel) {
+	onChannelQueue, exists := h.onChannelEventQueues[transportPtr]
+	if !exists {
+		return
+	}
+
+	if h.onChannelHandler != nil {
+		h.onChannelHandler(channel, uintptr(unsafe.Pointer(&channel)))
+	}
+	h.setupChannelEvents(&channel)
+	onChannelQueue.Enqueue(uintptr(unsafe.Pointer(&channel)))
+}
+
 func (h *CallbackHandler) setupChannelEvents(channel *channel.Channel) {
 	ptr := uintptr(unsafe.Pointer(channel))
 	onChannelClosedQueue := queue.NewQueue()
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/tkmn0/sylph"
 	"github.com/tkmn0/sylph/examples/util"
 	"github.com/tkmn0/sylph/pkg/channel"
@@ -18,8 +21,16 @@ func main() {
 			Unordered:        false,
 			ReliabliityType:  channel.ReliabilityTypeReliable,
 			ReliabilityValue: 0,
+			Label:            "chat",
 		}
-		t.OpenChannel(c)
+		go func() {
+			ch, err := t.OpenChannel(context.Background(), c)
+			if err != nil {
+				fmt.Println("open channel error", err)
+				return
+			}
+			util.Chat(ch)
+		}()
 	})
 
 	client.Connect("127.0.0.1", 4444, sylph.TransportConfig{
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -16,7 +17,7 @@ func main() {
 
 	c.OnTransport(func(t sylph.Transport) {
 		fmt.Println("client on transport:", t.Id())
-		t.OnChannel(func(c channel.Channel) {
+		handleChannel := func(c channel.Channel) {
 			fmt.Println("client on channel")
 			c.OnClose(func() {
 				fmt.Println("client channel on close")
@@ -50,7 +51,9 @@ func main() {
 					counter++
 				}
 			}()
-		})
+		}
+		// channels opened again after reconnection are passed to OnChannel.
+		t.OnChannel(handleChannel)
 
 		t.OnClose(func() {
 			fmt.Println("client transport on close")
@@ -60,7 +63,14 @@ func main() {
 			ReliabliityType:  channel.ReliabilityTypeReliable,
 			ReliabilityValue: 0,
 		}
-		t.OpenChannel(c)
+		go func() {
+			ch, err := t.OpenChannel(context.Background(), c)
+			if err != nil {
+				fmt.Println("open channel error", err)
+				return
+			}
+			handleChannel(ch)
+		}()
 	})
 
 	c.Connect("127.0.0.1", 4444, sylph.TransportConfig{
@@ -52,8 +52,11 @@ func main() {
 			fmt.Println("transport closed")
 		})
 	})
-	s.Run("127.0.0.1", 4444, sylph.TransportConfig{
+	err := s.Run("127.0.0.1", 4444, sylph.TransportConfig{
 		HeartbeatRateMillisec:   1000,
 		TimeOutDurationMilliSec: 300,
 	})
+	if err != nil {
+		fmt.Println("server run error:", err)
+	}
 }
@@ -8,4 +8,5 @@ require (
 	github.com/pion/dtls/v2 v2.0.2
 	github.com/pion/logging v0.2.2
 	github.com/pion/sctp v1.7.9
+	github.com/pion/transport v0.10.1
 )
@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// DcepMessageType is the message type of Data Channel Establishment Protocol (RFC 8832).
+type DcepMessageType uint8
+
+const (
+	DcepMessageTypeAck  DcepMessageType = 0x02
+	DcepMessageTypeOpen DcepMessageType = 0x03
+)
+
+// dcepChannelTypeUnordered is set in DcepOpenMessage.ChannelType for unordered channels.
+// The other bits are the reliability type, reliable (0), rexmit (1) or timed (2).
+const dcepChannelTypeUnordered = 0x80
+
+// dcepOpenHeaderLength is the length of DATA_CHANNEL_OPEN before the label.
+const dcepOpenHeaderLength = 12
+
+// maxDcepMessageSize is the max size of a message on DCEP channels, which are not framed.
+// A message is read at once, and sctp stream sends up to 65535 bytes at once.
+const maxDcepMessageSize = 65535
+
+var errInvalidDcepMessage = errors.New("invalid dcep message")
+
+// DcepOpenMessage is DATA_CHANNEL_OPEN, sent by the side opening a channel.
+type DcepOpenMessage struct {
+	ChannelType          uint8
+	Priority             uint16
+	ReliabilityParameter uint32
+	Label                string
+	Protocol             string
+}
+
+// NewDcepOpenMessage creates DcepOpenMessage with the reliability of a channel.
+func NewDcepOpenMessage(unordered bool, reliabilityType byte, reliabilityValue uint32, label string, protocol string) DcepOpenMessage {
+	channelType := reliabilityType
+	if unordered {
+		channelType |= dcepChannelTypeUnordered
+	}
+	return DcepOpenMessage{
+		ChannelType:          channelType,
+		ReliabilityParameter: reliabilityValue,
+		Label:                label,
+		Protocol:             protocol,
+	}
+}
+
+// Unordered reports whether the channel is unordered.
+func (m DcepOpenMessage) Unordered() bool {
+	return m.ChannelType&dcepChannelTypeUnordered != 0
+}
+
+// ReliabilityType returns the reliability type of the channel.
+func (m DcepOpenMessage) ReliabilityType() byte {
+	return m.ChannelType &^ dcepChannelTypeUnordered
+}
+
+// DcepOpenMessage builds DATA_CHANNEL_OPEN, which is sent at once and limited to maxDcepMessageSize.
+func (b *MessageBuilder) DcepOpenMessage(m DcepOpenMessage) ([]byte, error) {
+	if dcepOpenHeaderLength+len(m.Label)+len(m.Protocol) > maxDcepMessageSize {
+		return nil, ErrFieldTooLarge
+	}
+	buffer := make([]byte, dcepOpenHeaderLength+len(m.Label)+len(m.Protocol))
+	buffer[0] = uint8(DcepMessageTypeOpen)
+	buffer[1] = m.ChannelType
+	binary.BigEndian.PutUint16(buffer[2:], m.Priority)
+	binary.BigEndian.PutUint32(buffer[4:], m.ReliabilityParameter)
+	binary.BigEndian.PutUint16(buffer[8:], uint16(len(m.Label)))
+	binary.BigEndian.PutUint16(buffer[10:], uint16(len(m.Protocol)))
+	copy(buffer[dcepOpenHeaderLength:], m.Label)
+	copy(buffer[dcepOpenHeaderLength+len(m.Label):], m.Protocol)
+	return buffer, nil
+}
+
+func (b *MessageBuilder) DcepAckMessage() []byte {
+	return []byte{uint8(DcepMessageTypeAck)}
+}
+
+// ParceDcep parses a message of Data Channel Establishment Protocol.
+// DcepOpenMessage is returned only for DcepMessageTypeOpen.
+func (p *MessageParcer) ParceDcep(buff []byte) (DcepMessageType, DcepOpenMessage, error) {
+	if len(buff) == 0 {
+		return 0, DcepOpenMessage{}, errInvalidDcepMessage
+	}
+
+	switch DcepMessageType(buff[0]) {
+	case DcepMessageTypeAck:
+		return DcepMessageTypeAck, DcepOpenMessage{}, nil
+	case DcepMessageTypeOpen:
+		if len(buff) < dcepOpenHeaderLength {
+			return 0, DcepOpenMessage{}, errInvalidDcepMessage
+		}
+		labelLength := int(binary.BigEndian.Uint16(buff[8:]))
+		protocolLength := int(binary.BigEndian.Uint16(buff[10:]))
+		if len(buff) < dcepOpenHeaderLength+labelLength+protocolLength {
+			return 0, DcepOpenMessage{}, errInvalidDcepMessage
+		}
+		label := buff[dcepOpenHeaderLength : dcepOpenHeaderLength+labelLength]
+		protocol := buff[dcepOpenHeaderLength+labelLength : dcepOpenHeaderLength+labelLength+protocolLength]
+		return DcepMessageTypeOpen, DcepOpenMessage{
+			ChannelType:          buff[1],
+			Priority:             binary.BigEndian.Uint16(buff[2:]),
+			ReliabilityParameter: binary.BigEndian.Uint32(buff[4:]),
+			Label:                string(label),
+			Protocol:             string(protocol),
+		}, nil
+	}
+	return 0, DcepOpenMessage{}, errInvalidDcepMessage
+}
@@ -4,7 +4,18 @@ import (
 	"time"
 )
 
+// DefaultMaxMessageSize is the max message size when EngineConfig.MaxMessageSize is 0.
+const DefaultMaxMessageSize = 1024 * 1024
+
 type EngineConfig struct {
 	HeartbeatRateMillisec  time.Duration
 	TimeOutDurationMilliSec time.Duration
+	MaxMessageSize          int
+}
+
+func (c EngineConfig) maxMessageSize() int {
+	if c.MaxMessageSize <= 0 {
+		return DefaultMaxMessageSize
+	}
+	return c.MaxMessageSize
 }
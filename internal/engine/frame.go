@@ -0,0 +1,91 @@
+package engine
+
+import "encoding/binary"
+
+// Frames of sylph protocol.
+//
+// Every message on framed streams is a frame with the header below, followed by the payload.
+//
+//	 0        1        2        3        4
+//	+--------+--------+--------+--------+--------+----------
+//	|version |  type  | flags  |     length      | payload
+//	+--------+--------+--------+--------+--------+----------
+//
+// version is the protocol version with the high bit set, 0x81 for version 1.
+// type is MessageType, flags are reserved for later versions and 0,
+// and length is the length of the payload in big endian.
+// The header is the same in later versions, so that frames of any version can be parsed.
+//
+// Version 0 (ProtocolVersionLegacy) is the format of earlier releases,
+// which has only the message type before the payload. The type never has the high bit set,
+// so frames of version 0 are told from versioned ones by the first byte.
+//
+// The initialize message is encoded in TLV, a type byte and a length of 2 bytes in big endian
+// followed by the value for each field. Unknown types are skipped, so that later versions can add fields.
+// Version 0 encodes the initialize message in JSON.
+//
+// Client sends ProtocolVersion and its capabilities in the initialize message of the base stream,
+// and Server replies the negotiated ones: the lower version and the capabilities of both sides.
+// The initialize message of the base stream is sent in a frame of version 0 and JSON,
+// so that Servers of version 0 read it, and Client uses the version of the reply after that.
+// Version 0 sends no version, and the other side keeps version 0 without capabilities then.
+
+// ProtocolVersion is the version of sylph protocol implemented by this package.
+const ProtocolVersion uint8 = 1
+
+// ProtocolVersionLegacy is the version of earlier releases, without frame header.
+const ProtocolVersionLegacy uint8 = 0
+
+// Capability is a feature of the protocol, negotiated in the initialize message of the base stream.
+type Capability uint32
+
+const (
+	// CapabilityChunk is set when the side reassembles messages sent in chunks.
+	CapabilityChunk Capability = 1 << iota
+)
+
+// frameVersionBit is set in the first byte of versioned frames.
+const frameVersionBit = 0x80
+
+// frameHeaderLength is the length of the header of versioned frames.
+const frameHeaderLength = 5
+
+// headerLength returns the length of the frame header of the version.
+func headerLength(version uint8) int {
+	if version == ProtocolVersionLegacy {
+		return 1
+	}
+	return frameHeaderLength
+}
+
+// BuildFrame builds a frame of the version with the message type and the payload.
+func (b *MessageBuilder) BuildFrame(version uint8, t MessageType, payload []byte) []byte {
+	if version == ProtocolVersionLegacy {
+		return append([]byte{uint8(t)}, payload...)
+	}
+	frame := make([]byte, frameHeaderLength+len(payload))
+	frame[0] = frameVersionBit | version
+	frame[1] = uint8(t)
+	binary.BigEndian.PutUint16(frame[3:], uint16(len(payload)))
+	copy(frame[frameHeaderLength:], payload)
+	return frame
+}
+
+// parceFrame returns the version, the message type and the payload of a frame.
+// false is returned for invalid frames.
+func parceFrame(buff []byte) (uint8, MessageType, []byte, bool) {
+	if len(buff) == 0 {
+		return 0, MessageTypeUnknown, nil, false
+	}
+	if buff[0]&frameVersionBit == 0 {
+		return ProtocolVersionLegacy, MessageType(buff[0]), buff[1:], true
+	}
+	if len(buff) < frameHeaderLength || buff[0] == frameVersionBit {
+		return 0, MessageTypeUnknown, nil, false
+	}
+	length := int(binary.BigEndian.Uint16(buff[3:]))
+	if len(buff) < frameHeaderLength+length {
+		return 0, MessageTypeUnknown, nil, false
+	}
+	return buff[0] &^ frameVersionBit, MessageType(buff[1]), buff[frameHeaderLength : frameHeaderLength+length], true
+}
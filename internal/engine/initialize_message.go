@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Types of TLV fields in the initialize message.
+const (
+	tlvStreamType      = 0x01
+	tlvTransportId     = 0x02
+	tlvAuthPayload     = 0x03
+	tlvError           = 0x04
+	tlvResumptionToken = 0x05
+	tlvLabel           = 0x06
+	tlvProtocol        = 0x07
+	tlvVersion         = 0x08
+	tlvCapabilities    = 0x09
+	tlvHeartbeatRate   = 0x0a
+	tlvTimeOutDuration = 0x0b
+	tlvMaxMessageSize  = 0x0c
+)
+
+// tlvHeaderLength is the length of the type and the length of a TLV field.
+const tlvHeaderLength = 3
+
+// maxFieldLength is the max length of a value of TLV fields.
+const maxFieldLength = 65535
+
+var errInvalidInitializeMessage = errors.New("invalid initialize message")
+
+// ErrFieldTooLarge is returned when a value of the initialize message or DATA_CHANNEL_OPEN is over 65535 bytes.
+var ErrFieldTooLarge = errors.New("field of the initialize message is over 65535 bytes")
+
+// InitializeMessage builds frames of the initialize message of the version, JSON for ProtocolVersionLegacy
+// and TLV for others. Empty strings and bytes, and zero of config values are omitted.
+// A message larger than a frame is fragmented into MessageTypeInitializeChunk frames with the message id.
+func (b *MessageBuilder) InitializeMessage(version uint8, m InitializeMessage, id uint32) ([][]byte, error) {
+	payload, err := encodeInitializeMessage(version, m)
+	if err != nil {
+		return nil, err
+	}
+	return b.buildChunks(version, MessageTypeInitialize, MessageTypeInitializeChunk, payload, id), nil
+}
+
+// validate returns ErrFieldTooLarge when a field is too large to be encoded in TLV, in either encoding.
+func (m InitializeMessage) validate() error {
+	for _, length := range []int{len(m.TransportId), len(m.AuthPayload), len(m.Error), len(m.ResumptionToken), len(m.Label), len(m.Protocol)} {
+		if length > maxFieldLength {
+			return ErrFieldTooLarge
+		}
+	}
+	return nil
+}
+
+func encodeInitializeMessage(version uint8, m InitializeMessage) ([]byte, error) {
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	if version == ProtocolVersionLegacy {
+		return json.Marshal(&m)
+	}
+
+	payload := []byte{}
+	put := func(t uint8, value []byte) {
+		if len(value) == 0 {
+			return
+		}
+		field := make([]byte, tlvHeaderLength+len(value))
+		field[0] = t
+		binary.BigEndian.PutUint16(field[1:], uint16(len(value)))
+		copy(field[tlvHeaderLength:], value)
+		payload = append(payload, field...)
+	}
+	putUint32 := func(t uint8, value uint32, omitZero bool) {
+		if value == 0 && omitZero {
+			return
+		}
+		field := make([]byte, 4)
+		binary.BigEndian.PutUint32(field, value)
+		put(t, field)
+	}
+
+	put(tlvStreamType, []byte{m.StreamType})
+	put(tlvTransportId, []byte(m.TransportId))
+	put(tlvAuthPayload, m.AuthPayload)
+	put(tlvError, []byte(m.Error))
+	put(tlvResumptionToken, []byte(m.ResumptionToken))
+	put(tlvLabel, []byte(m.Label))
+	put(tlvProtocol, []byte(m.Protocol))
+	put(tlvVersion, []byte{m.Version})
+	putUint32(tlvCapabilities, uint32(m.Capabilities), false)
+	putUint32(tlvHeartbeatRate, m.HeartbeatRateMillisec, true)
+	putUint32(tlvTimeOutDuration, m.TimeOutDurationMilliSec, true)
+	putUint32(tlvMaxMessageSize, m.MaxMessageSize, true)
+	return payload, nil
+}
+
+// ParceInitializeMessage parses the payload of the initialize message of the version.
+func (p *MessageParcer) ParceInitializeMessage(version uint8, buff []byte) (InitializeMessage, error) {
+	var m InitializeMessage
+	if version == ProtocolVersionLegacy {
+		err := json.Unmarshal(buff, &m)
+		return m, err
+	}
+
+	for len(buff) > 0 {
+		if len(buff) < tlvHeaderLength {
+			return m, errInvalidInitializeMessage
+		}
+		t := buff[0]
+		length := int(binary.BigEndian.Uint16(buff[1:]))
+		if len(buff) < tlvHeaderLength+length {
+			return m, errInvalidInitializeMessage
+		}
+		value := buff[tlvHeaderLength : tlvHeaderLength+length]
+		buff = buff[tlvHeaderLength+length:]
+
+		switch t {
+		case tlvStreamType:
+			if length > 0 {
+				m.StreamType = value[0]
+			}
+		case tlvTransportId:
+			m.TransportId = string(value)
+		case tlvAuthPayload:
+			m.AuthPayload = value
+		case tlvError:
+			m.Error = string(value)
+		case tlvResumptionToken:
+			m.ResumptionToken = string(value)
+		case tlvLabel:
+			m.Label = string(value)
+		case tlvProtocol:
+			m.Protocol = string(value)
+		case tlvVersion:
+			if length > 0 {
+				m.Version = value[0]
+			}
+		case tlvCapabilities:
+			if length >= 4 {
+				m.Capabilities = Capability(binary.BigEndian.Uint32(value))
+			}
+		case tlvHeartbeatRate:
+			if length >= 4 {
+				m.HeartbeatRateMillisec = binary.BigEndian.Uint32(value)
+			}
+		case tlvTimeOutDuration:
+			if length >= 4 {
+				m.TimeOutDurationMilliSec = binary.BigEndian.Uint32(value)
+			}
+		case tlvMaxMessageSize:
+			if length >= 4 {
+				m.MaxMessageSize = binary.BigEndian.Uint32(value)
+			}
+		}
+	}
+	return m, nil
+}
@@ -1,25 +1,75 @@
 package engine
 
 import (
-	"encoding/json"
+	"encoding/binary"
 )
 
+// maxFrameSize is the max size of a frame written to sctp stream, which is the max message size of sctp.
+// sctp fragments and reassembles a frame by itself, and it is the buffer size of reading as well.
+const maxFrameSize = 65535
+
+// legacyFrameSize is the buffer size of reading of the other side without CapabilityChunk.
+const legacyFrameSize = 1024
+
+// chunkHeaderLength is the length of the header in the payload of MessageTypeChunk,
+// which has the message id, the index of the chunk and the number of the chunks.
+const chunkHeaderLength = 12
+
+// frameSize returns the max size of a frame of the version.
+// Frames of ProtocolVersionLegacy are limited to the buffer of earlier releases.
+func frameSize(version uint8) int {
+	if version == ProtocolVersionLegacy {
+		return legacyFrameSize
+	}
+	return maxFrameSize
+}
+
+// chunkPayloadLength returns the length of a message in every chunk but the last one.
+func chunkPayloadLength(version uint8) int {
+	return frameSize(version) - headerLength(version) - chunkHeaderLength
+}
+
 type MessageBuilder struct{}
 
 func NewMessageBuilder() *MessageBuilder {
 	return &MessageBuilder{}
 }
 
-func (b *MessageBuilder) BuildMessage(buffer []byte, t MessageType) []byte {
-	payload := []byte{uint8(t)}
-	return append(payload[:], buffer[:]...)
+// BuildChunks builds frames of a message. A message fitting in a frame is built as MessageTypeBody,
+// and a larger message is fragmented into MessageTypeChunk frames with the message id.
+// The header of the chunks lets the other side reassemble them in any order, for unordered streams.
+func (b *MessageBuilder) BuildChunks(version uint8, buffer []byte, id uint32) [][]byte {
+	return b.buildChunks(version, MessageTypeBody, MessageTypeChunk, buffer, id)
+}
+
+// buildChunks builds a message fitting in a frame as t, and fragments a larger message into frames of chunkType.
+func (b *MessageBuilder) buildChunks(version uint8, t MessageType, chunkType MessageType, buffer []byte, id uint32) [][]byte {
+	if headerLength(version)+len(buffer) <= frameSize(version) {
+		return [][]byte{b.BuildFrame(version, t, buffer)}
+	}
+
+	length := chunkPayloadLength(version)
+	count := (len(buffer) + length - 1) / length
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		payload := buffer[i*length:]
+		if len(payload) > length {
+			payload = payload[:length]
+		}
+		chunk := make([]byte, chunkHeaderLength+len(payload))
+		binary.BigEndian.PutUint32(chunk, id)
+		binary.BigEndian.PutUint32(chunk[4:], uint32(i))
+		binary.BigEndian.PutUint32(chunk[8:], uint32(count))
+		copy(chunk[chunkHeaderLength:], payload)
+		chunks[i] = b.BuildFrame(version, chunkType, chunk)
+	}
+	return chunks
 }
 
-func (b *MessageBuilder) HeartBeatmessage() []byte {
-	return []byte{uint8(MessageTypeHeartBeat)}
+func (b *MessageBuilder) HeartBeatmessage(version uint8) []byte {
+	return b.BuildFrame(version, MessageTypeHeartBeat, nil)
 }
 
-func (b *MessageBuilder) InitializeMessage(m InitializeMessage) []byte {
-	bytes, _ := json.Marshal(&m)
-	return append([]byte{uint8(MessageTypeInitialize)}, bytes[:]...)
+func (b *MessageBuilder) GoingAwayMessage(version uint8) []byte {
+	return b.BuildFrame(version, MessageTypeGoingAway, nil)
 }
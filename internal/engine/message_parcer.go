@@ -1,33 +1,126 @@
 package engine
 
+import "encoding/binary"
+
+// maxPartialMessages limits messages being reassembled at once.
+// Chunks of unreliable streams may be lost, and the oldest partial message is dropped over the limit.
+const maxPartialMessages = 16
+
 type MessageParcer struct {
-	buffer []byte
+	messages map[uint32]*partialMessage
+	order    []uint32
+}
+
+// partialMessage is a message being reassembled from its chunks.
+type partialMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
 }
 
 func NewMessageParcer() *MessageParcer {
-	return &MessageParcer{}
+	return &MessageParcer{
+		messages: map[uint32]*partialMessage{},
+	}
 }
 
-func (p *MessageParcer) Parce(buff []byte) (MessageType, []byte) {
-	switch buff[0] {
-	case uint8(MessageTypeHeartBeat):
-		return MessageTypeHeartBeat, nil
-	case uint8(MessageTypeBody):
-		if p.buffer != nil {
-			data := append(p.buffer, buff[1:]...)
-			p.buffer = nil
-			return MessageTypeBody, data
-		} else {
-			return MessageTypeBody, buff[1:]
+// Parce parses a frame of any protocol version, and returns the version of the frame.
+// buff is reused by the caller, and the returned payload is a copy.
+// MessageTypeBody or MessageTypeInitialize is returned with a reassembled message
+// when the last chunk of the message arrived, and MessageTypeChunk is returned before that.
+// MessageTooLargeError is returned for a message over maxMessageSize, which is dropped.
+func (p *MessageParcer) Parce(buff []byte, maxMessageSize int) (MessageType, uint8, []byte, error) {
+	version, t, payload, ok := parceFrame(buff)
+	if !ok {
+		return MessageTypeUnknown, version, nil, nil
+	}
+
+	switch t {
+	case MessageTypeHeartBeat:
+		return MessageTypeHeartBeat, version, nil, nil
+	case MessageTypeBody:
+		return MessageTypeBody, version, copyBytes(payload), nil
+	case MessageTypeChunk:
+		data, ok, err := p.reassemble(version, payload, maxMessageSize)
+		if ok {
+			return MessageTypeBody, version, data, nil
 		}
-	case uint8(MessageTypeChunk):
-		if p.buffer == nil {
-			p.buffer = []byte{}
+		return MessageTypeChunk, version, nil, err
+	case MessageTypeInitialize:
+		return MessageTypeInitialize, version, copyBytes(payload), nil
+	case MessageTypeInitializeChunk:
+		data, ok, err := p.reassemble(version, payload, maxMessageSize)
+		if ok {
+			return MessageTypeInitialize, version, data, nil
+		}
+		return MessageTypeChunk, version, nil, err
+	case MessageTypeGoingAway:
+		return MessageTypeGoingAway, version, nil, nil
+	}
+	return MessageTypeUnknown, version, nil, nil
+}
+
+// reassemble adds a chunk to its message, and returns the message when all chunks arrived.
+// Invalid chunks are dropped, and messages over the max message size are dropped with MessageTooLargeError.
+func (p *MessageParcer) reassemble(version uint8, buff []byte, maxMessageSize int) ([]byte, bool, error) {
+	if len(buff) < chunkHeaderLength {
+		return nil, false, nil
+	}
+	id := binary.BigEndian.Uint32(buff)
+	index := binary.BigEndian.Uint32(buff[4:])
+	count := binary.BigEndian.Uint32(buff[8:])
+	if index >= count {
+		return nil, false, nil
+	}
+	if size := uint64(count-1) * uint64(chunkPayloadLength(version)); size >= uint64(maxMessageSize) {
+		// the chunks before the last one are over the limit already.
+		return nil, false, &MessageTooLargeError{Size: int(size) + 1, MaxMessageSize: maxMessageSize}
+	}
+
+	m, exists := p.messages[id]
+	if !exists {
+		if len(p.order) >= maxPartialMessages {
+			p.drop(p.order[0])
+		}
+		m = &partialMessage{chunks: make([][]byte, count)}
+		p.messages[id] = m
+		p.order = append(p.order, id)
+	}
+	if int(count) != len(m.chunks) || m.chunks[index] != nil {
+		return nil, false, nil
+	}
+
+	m.chunks[index] = copyBytes(buff[chunkHeaderLength:])
+	m.received++
+	m.size += len(buff) - chunkHeaderLength
+	if m.size > maxMessageSize {
+		p.drop(id)
+		return nil, false, &MessageTooLargeError{Size: m.size, MaxMessageSize: maxMessageSize}
+	}
+	if m.received < len(m.chunks) {
+		return nil, false, nil
+	}
+
+	p.drop(id)
+	data := make([]byte, 0, m.size)
+	for _, chunk := range m.chunks {
+		data = append(data, chunk...)
+	}
+	return data, true, nil
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+func (p *MessageParcer) drop(id uint32) {
+	delete(p.messages, id)
+	for i, o := range p.order {
+		if o == id {
+			p.order = append(p.order[:i], p.order[i+1:]...)
+			break
 		}
-		p.buffer = append(p.buffer, buff[1:]...)
-		return MessageTypeChunk, nil
-	case uint8(MessageTypeInitialize):
-		return MessageTypeInitialize, buff[1:]
 	}
-	return MessageTypeUnknown, nil
 }
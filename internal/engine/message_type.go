@@ -8,9 +8,33 @@ const (
 	MessageTypeChunk
 	MessageTypeUnknown
 	MessageTypeInitialize
+	MessageTypeGoingAway
+	// MessageTypeInitializeChunk is a chunk of the initialize message larger than a frame.
+	MessageTypeInitializeChunk
 )
 
+// InitializeMessage is sent by the side opening a stream, and replied by the accepting side.
+// A reply has stream type StreamTypeUnKnown.
+// AuthPayload is sent by Client on the base stream.
+// Error is set in the reply of the base stream when Server rejected the transport.
+// ResumptionToken is sent by Client on the base stream to resume the previous transport,
+// and Server replies a new token for the next resumption.
+// Version and Capabilities are sent by Client on the base stream, and Server replies the negotiated ones.
+// HeartbeatRateMillisec, TimeOutDurationMilliSec and MaxMessageSize are sent by Client on the base stream,
+// and Server replies the negotiated ones.
+// Client sends them in JSON of ProtocolVersionLegacy as well, which earlier releases ignore.
 type InitializeMessage struct {
-	StreamType  uint8  `json:"stream_type"`
-	TransportId string `json:"transport_id"`
+	StreamType      uint8      `json:"stream_type"`
+	TransportId     string     `json:"transport_id"`
+	AuthPayload     []byte     `json:"auth_payload,omitempty"`
+	Error           string     `json:"error,omitempty"`
+	ResumptionToken string     `json:"resumption_token,omitempty"`
+	Label           string     `json:"label,omitempty"`
+	Protocol        string     `json:"protocol,omitempty"`
+	Version         uint8      `json:"version,omitempty"`
+	Capabilities    Capability `json:"capabilities,omitempty"`
+
+	HeartbeatRateMillisec   uint32 `json:"heartbeat_rate_millisec,omitempty"`
+	TimeOutDurationMilliSec uint32 `json:"time_out_duration_millisec,omitempty"`
+	MaxMessageSize          uint32 `json:"max_message_size,omitempty"`
 }
@@ -1,128 +1,350 @@
 package engine
 
 import (
-	"encoding/json"
+	"fmt"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tkmn0/sylph/internal/stream"
+	"github.com/tkmn0/sylph/internal/timer"
 )
 
+// wheel schedules heartbeat and health check of all engines,
+// so that idle transports run no goroutines or tickers for them.
+var wheel = timer.NewWheel(time.Millisecond*10, 512)
+
+// MessageTooLargeError is returned when sending a message over the max message size.
+type MessageTooLargeError struct {
+	Size           int
+	MaxMessageSize int
+}
+
+func (e *MessageTooLargeError) Error() string {
+	return fmt.Sprintf("message size %d exceeds max message size %d", e.Size, e.MaxMessageSize)
+}
+
 type StreamEngine struct {
-	close                   chan bool
-	err                     chan error
+	messageId               uint32
+	stream                  stream.Stream
+	closed                  bool
+	done                    chan struct{}
+	heartbeat               chan struct{}
+	timeout                 chan struct{}
 	builder                 *MessageBuilder
 	parcer                  *MessageParcer
 	lastHeartbeat           time.Time
 	lock                    sync.RWMutex
 	heartbeatRateMillisec   time.Duration
-	healthCheckRateMillisec time.Duration
 	timeOutDurationMillisec time.Duration
+	maxMessageSize          int
+	dcep                    bool
+	version                 uint8
+	capabilities            Capability
+	timedOut                bool
+	timerLock               sync.Mutex
+	heartbeatTimer          *timer.Timer
+	healthCheckTimer        *timer.Timer
+	stopped                 bool
 	OnStreamClosed          func(stream stream.Stream)
+	OnStreamError           func(stream stream.Stream, err error)
 	OnStream                func(stream stream.Stream, messge InitializeMessage)
+	OnGoingAway             func(stream stream.Stream)
+	OnDcepOpen              func(stream stream.Stream, message DcepOpenMessage)
+	OnDcepAck               func(stream stream.Stream)
 }
 
 func NewStreamEngine(config EngineConfig) *StreamEngine {
 	return &StreamEngine{
+		done:                    make(chan struct{}),
+		heartbeat:               make(chan struct{}, 1),
+		timeout:                 make(chan struct{}, 1),
 		builder:                 NewMessageBuilder(),
 		parcer:                  NewMessageParcer(),
 		heartbeatRateMillisec:   1000,
-		healthCheckRateMillisec: 100,
 		timeOutDurationMillisec: 300,
+		maxMessageSize:          config.maxMessageSize(),
+		version:                 ProtocolVersion,
+		capabilities:            CapabilityChunk,
 	}
 }
 
-func (e *StreamEngine) Run(s stream.Stream, t stream.StreamType, config EngineConfig, transportId string) {
+// SetConfig changes heartbeat rate, timeout and max message size to the ones negotiated with the other side.
+// Heartbeat and health check scheduled already are not rescheduled.
+func (e *StreamEngine) SetConfig(config EngineConfig) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
 	e.heartbeatRateMillisec = config.HeartbeatRateMillisec
 	e.timeOutDurationMillisec = config.TimeOutDurationMilliSec
+	e.maxMessageSize = config.maxMessageSize()
+}
+
+// messageSizeLimit returns the max message size. DCEP channels send a message at once, and it is limited more.
+func (e *StreamEngine) messageSizeLimit() int {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	if e.dcep && e.maxMessageSize > maxDcepMessageSize {
+		return maxDcepMessageSize
+	}
+	return e.maxMessageSize
+}
+
+// SetProtocol changes the protocol version and capabilities negotiated with the other side.
+func (e *StreamEngine) SetProtocol(version uint8, capabilities Capability) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.version = version
+	e.capabilities = capabilities
+}
+
+func (e *StreamEngine) protocol() (uint8, Capability) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.version, e.capabilities
+}
+
+// Run runs the engine for the base stream, which sends heartbeat to track liveness of the transport.
+func (e *StreamEngine) Run(s stream.Stream, config EngineConfig) {
+	e.SetConfig(config)
+	e.RunChannel(s)
+	go e.keepAlive(s)
+	e.scheduleHeartbeat()
+}
+
+// RunChannel runs the engine for an app stream. App streams send no heartbeat,
+// since the base stream tracks liveness of the whole transport.
+// Messages larger than a frame are sent in chunks, and reassembled by the other side.
+func (e *StreamEngine) RunChannel(s stream.Stream) {
 	s.OnDataSendHandler(func(data []byte) (int, error) {
-		return s.WriteData(e.builder.BuildMessage(data, MessageTypeBody))
+		return e.sendChunks(s.WriteData, data)
 	})
 	s.OnMessageHandler(func(message string) (int, error) {
-		return s.WriteMessage(e.builder.BuildMessage([]byte(message), MessageTypeBody))
+		return e.sendChunks(s.WriteMessage, []byte(message))
 	})
-	s.OnCloseHandler(func() {
-		time.Sleep(time.Millisecond * 1)
-		if e.close != nil {
-			e.close <- true
-		}
+	s.OnCloseHandler(e.onClose)
 
+	e.setStream(s)
+	go e.readStream(s)
+}
+
+// RunDcep runs the engine for a channel established with Data Channel Establishment Protocol.
+// Messages are sent without framing and heartbeat of sylph, as WebRTC data channels do.
+func (e *StreamEngine) RunDcep(s stream.Stream) {
+	e.dcep = true
+	s.OnDataSendHandler(func(data []byte) (int, error) {
+		if err := e.checkMessageSize(data); err != nil {
+			return 0, err
+		}
+		return s.WritePayload(data, stream.PayloadTypeBinary)
 	})
+	s.OnMessageHandler(func(message string) (int, error) {
+		if err := e.checkMessageSize([]byte(message)); err != nil {
+			return 0, err
+		}
+		return s.WritePayload([]byte(message), stream.PayloadTypeString)
+	})
+	s.OnCloseHandler(e.onClose)
 
-	e.close = make(chan bool)
-	e.err = make(chan error)
-	e.setupStream(s, t, transportId)
-	e.observeStatus(s)
-	go e.handleHeartBeat(s)
-	go e.handleHealthCheck()
-	go e.readStream(s)
+	e.setStream(s)
+	go e.readDcepStream(s)
+}
+
+func (e *StreamEngine) setStream(s stream.Stream) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.stream = s
+}
+
+func (e *StreamEngine) onClose() {
+	time.Sleep(time.Millisecond * 1)
+	e.requestClose()
 }
 
 func (e *StreamEngine) Stop() {
-	if e.close != nil {
-		e.close <- true
+	e.stopTimers()
+	e.requestClose()
+}
+
+// requestClose calls OnStreamClosed on the goroutine closing the stream.
+// This does nothing after the engine stopped.
+func (e *StreamEngine) requestClose() {
+	if s := e.finish(); s != nil && e.OnStreamClosed != nil {
+		e.OnStreamClosed(s)
 	}
 }
 
-func (e *StreamEngine) setupStream(s stream.Stream, t stream.StreamType, id string) {
-	_, err := s.WriteData(e.builder.InitializeMessage(InitializeMessage{
-		StreamType:  uint8(t),
-		TransportId: id,
-	}))
-	e.checkError(err)
+// fail closes the stream with the error, and calls OnStreamError. This does nothing after the engine stopped.
+func (e *StreamEngine) fail(err error) {
+	if s := e.finish(); s != nil {
+		s.Error(err)
+		if e.OnStreamError != nil {
+			e.OnStreamError(s, err)
+		}
+	}
 }
 
-func (e *StreamEngine) observeStatus(s stream.Stream) {
-	go func() {
-		select {
-		case closed, ok := <-e.close:
-			e.close = nil
-			if ok {
-				if closed {
-					if e.OnStreamClosed != nil {
-						e.OnStreamClosed(s)
-					}
-				}
-			}
-		case err := <-e.err:
-			if err != nil {
-				s.Error(err)
-			}
+// finish stops the engine once, and returns the stream to be closed.
+// nil is returned when the engine stopped already, or has not run.
+func (e *StreamEngine) finish() stream.Stream {
+	e.lock.Lock()
+	if e.closed {
+		e.lock.Unlock()
+		return nil
+	}
+	e.closed = true
+	s := e.stream
+	e.lock.Unlock()
+
+	close(e.done)
+	e.stopTimers()
+	return s
+}
+
+// isClosed reports closing or an error of the stream has been handled.
+func (e *StreamEngine) isClosed() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.closed
+}
+
+// sendChunks writes a message in chunks of frames, and returns the size of the message.
+// Without CapabilityChunk of the other side, a message is limited to the frame it reads.
+func (e *StreamEngine) sendChunks(write func(buffer []byte) (int, error), data []byte) (int, error) {
+	version, capabilities := e.protocol()
+	if capabilities&CapabilityChunk == 0 && headerLength(version)+len(data) > legacyFrameSize {
+		return 0, &MessageTooLargeError{Size: len(data), MaxMessageSize: legacyFrameSize - headerLength(version)}
+	}
+	if err := e.checkMessageSize(data); err != nil {
+		return 0, err
+	}
+	id := atomic.AddUint32(&e.messageId, 1)
+	for _, chunk := range e.builder.BuildChunks(version, data, id) {
+		if _, err := write(chunk); err != nil {
+			return 0, err
 		}
-	}()
+	}
+	return len(data), nil
 }
 
-func (e *StreamEngine) handleHeartBeat(s stream.Stream) {
-	ticker := time.NewTicker(time.Millisecond * e.heartbeatRateMillisec)
-loop:
+func (e *StreamEngine) checkMessageSize(data []byte) error {
+	if limit := e.messageSizeLimit(); len(data) > limit {
+		return &MessageTooLargeError{Size: len(data), MaxMessageSize: limit}
+	}
+	return nil
+}
+
+// SendInitializeMessage sends InitializeMessage to the other side of the stream, in chunks when it is larger than a frame.
+// ErrFieldTooLarge is returned when a field can not be encoded.
+func (e *StreamEngine) SendInitializeMessage(s stream.Stream, m InitializeMessage) error {
+	version, _ := e.protocol()
+	frames, err := e.builder.InitializeMessage(version, m, atomic.AddUint32(&e.messageId, 1))
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if _, err := s.WriteData(frame); err != nil {
+			e.checkError(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// SendGoingAwayMessage notifies the other side that this side is shutting down.
+func (e *StreamEngine) SendGoingAwayMessage(s stream.Stream) {
+	version, _ := e.protocol()
+	_, err := s.WriteData(e.builder.GoingAwayMessage(version))
+	e.checkError(err)
+}
+
+// SendDcepOpen sends DATA_CHANNEL_OPEN to the other side of the stream.
+func (e *StreamEngine) SendDcepOpen(s stream.Stream, m DcepOpenMessage) error {
+	message, err := e.builder.DcepOpenMessage(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.WritePayload(message, stream.PayloadTypeDcep)
+	e.checkError(err)
+	return err
+}
+
+// SendDcepAck sends DATA_CHANNEL_ACK to the other side of the stream.
+func (e *StreamEngine) SendDcepAck(s stream.Stream) {
+	_, err := s.WritePayload(e.builder.DcepAckMessage(), stream.PayloadTypeDcep)
+	e.checkError(err)
+}
+
+// keepAlive sends heartbeat and closes the stream when heartbeat timed out, on the goroutine of the base stream,
+// since callbacks of the shared wheel must not block.
+func (e *StreamEngine) keepAlive(s stream.Stream) {
 	for {
-		<-ticker.C
-		if e.close == nil {
-			break loop
+		select {
+		case <-e.heartbeat:
+			e.sendHeartbeat(s)
+		case <-e.timeout:
+			e.requestClose()
+			return
+		case <-e.done:
+			return
 		}
-		_, err := s.WriteData(e.builder.HeartBeatmessage())
-		e.checkError(err)
 	}
 }
 
+// scheduleHeartbeat wakes up keepAlive to send heartbeat after the heartbeat rate.
+func (e *StreamEngine) scheduleHeartbeat() {
+	e.timerLock.Lock()
+	defer e.timerLock.Unlock()
+	if e.stopped {
+		return
+	}
+	e.lock.RLock()
+	rate := e.heartbeatRateMillisec
+	e.lock.RUnlock()
+	e.heartbeatTimer = wheel.AfterFunc(time.Millisecond*rate, func() {
+		notify(e.heartbeat)
+	})
+}
+
+func (e *StreamEngine) sendHeartbeat(s stream.Stream) {
+	if e.isClosed() {
+		return
+	}
+	version, _ := e.protocol()
+	_, err := s.WriteData(e.builder.HeartBeatmessage(version))
+	if e.checkError(err) {
+		return
+	}
+	e.scheduleHeartbeat()
+}
+
+// notify sends a signal to keepAlive without blocking. A signal not received yet is not doubled.
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// readStream reads frames into a buffer reused for the stream, the parcer copies payloads out of it.
+// A message over the max message size fails the stream, which lets the other side know it by closing.
 func (e *StreamEngine) readStream(s stream.Stream) {
+	buffer := make([]byte, maxFrameSize)
 loop:
 	for {
-		e.lock.RLock()
-		if e.close == nil {
+		if e.isClosed() {
 			break loop
 		}
-		e.lock.RUnlock()
-		buffer := make([]byte, 1024)
 		l, err, isString := s.Read(buffer)
-		buffer = buffer[:l]
 		invalid := e.checkError(err)
 		if invalid {
 			return
 		}
 
-		mt, buff := e.parcer.Parce(buffer)
+		mt, version, buff, err := e.parcer.Parce(buffer[:l], e.messageSizeLimit())
+		if e.checkError(err) {
+			return
+		}
 		if mt == MessageTypeBody {
 			if isString {
 				s.Message(string(buff))
@@ -130,47 +352,126 @@ loop:
 				s.Data(buff)
 			}
 		} else if mt == MessageTypeInitialize {
-			var msg InitializeMessage
-			json.Unmarshal(buff, &msg)
+			msg, err := e.parcer.ParceInitializeMessage(version, buff)
+			if err != nil {
+				continue
+			}
+			if msg.Version == ProtocolVersionLegacy {
+				// the version of the frame, when the sender has not sent its version.
+				msg.Version = version
+			}
 			if e.OnStream != nil {
 				e.OnStream(s, msg)
 			}
+		} else if mt == MessageTypeGoingAway {
+			if e.OnGoingAway != nil {
+				e.OnGoingAway(s)
+			}
 		} else if mt == MessageTypeHeartBeat {
-			e.lock.Lock()
-			e.lastHeartbeat = time.Now()
-			e.lock.Unlock()
+			e.onHeartbeat()
 		}
 
 	}
 }
 
-func (e *StreamEngine) handleHealthCheck() {
-	ticker := time.NewTicker(time.Millisecond * e.healthCheckRateMillisec)
-loop:
+func (e *StreamEngine) readDcepStream(s stream.Stream) {
+	buffer := make([]byte, maxDcepMessageSize)
 	for {
-		<-ticker.C
-		e.lock.Lock()
-		if !e.lastHeartbeat.IsZero() {
-			if time.Since(e.lastHeartbeat) > time.Millisecond*(e.heartbeatRateMillisec+e.timeOutDurationMillisec) {
-				if e.close != nil {
-					e.close <- true
-				}
-				break loop
+		l, t, err := s.ReadPayload(buffer)
+		if e.checkError(err) {
+			return
+		}
+
+		switch t {
+		case stream.PayloadTypeDcep:
+			mt, m, err := e.parcer.ParceDcep(buffer[:l])
+			if err != nil {
+				continue
+			}
+			if mt == DcepMessageTypeOpen && e.OnDcepOpen != nil {
+				e.OnDcepOpen(s, m)
+			} else if mt == DcepMessageTypeAck && e.OnDcepAck != nil {
+				e.OnDcepAck(s)
 			}
+		case stream.PayloadTypeString:
+			s.Message(string(buffer[:l]))
+		default:
+			s.Data(copyBytes(buffer[:l]))
 		}
+	}
+}
+
+// onHeartbeat records heartbeat from the other side, and starts health check with the first one.
+func (e *StreamEngine) onHeartbeat() {
+	e.lock.Lock()
+	first := e.lastHeartbeat.IsZero()
+	e.lastHeartbeat = time.Now()
+	e.lock.Unlock()
+
+	if first {
+		e.scheduleHealthCheck(e.timeOutLimit())
+	}
+}
+
+// timeOutLimit is the duration without heartbeat to detect the other side is not living.
+func (e *StreamEngine) timeOutLimit() time.Duration {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return time.Millisecond * (e.heartbeatRateMillisec + e.timeOutDurationMillisec)
+}
+
+func (e *StreamEngine) scheduleHealthCheck(d time.Duration) {
+	e.timerLock.Lock()
+	defer e.timerLock.Unlock()
+	if e.stopped {
+		return
+	}
+	e.healthCheckTimer = wheel.AfterFunc(d, e.checkHealth)
+}
+
+// checkHealth lets keepAlive close the stream when heartbeat timed out,
+// otherwise checks again when the last heartbeat would time out.
+func (e *StreamEngine) checkHealth() {
+	limit := e.timeOutLimit()
+	e.lock.Lock()
+	elapsed := time.Since(e.lastHeartbeat)
+	if elapsed <= limit {
 		e.lock.Unlock()
+		e.scheduleHealthCheck(limit - elapsed)
+		return
 	}
+	e.timedOut = true
+	e.lock.Unlock()
+	notify(e.timeout)
+}
+
+// stopTimers cancels heartbeat and health check of the closed stream.
+func (e *StreamEngine) stopTimers() {
+	e.timerLock.Lock()
+	defer e.timerLock.Unlock()
+	e.stopped = true
+	if e.heartbeatTimer != nil {
+		e.heartbeatTimer.Stop()
+	}
+	if e.healthCheckTimer != nil {
+		e.healthCheckTimer.Stop()
+	}
+}
+
+// TimedOut reports whether the stream was closed because heartbeat from the other side timed out.
+func (e *StreamEngine) TimedOut() bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.timedOut
 }
 
 func (e *StreamEngine) checkError(err error) bool {
 	invalid := false
 	if err != nil {
 		if err == io.EOF {
-			if e.close != nil {
-				e.close <- true
-			}
+			e.requestClose()
 		} else {
-			e.err <- err
+			e.fail(err)
 		}
 		invalid = true
 	}
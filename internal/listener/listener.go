@@ -4,21 +4,31 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
-	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pion/dtls/v2"
 	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/tkmn0/sylph/internal/mux"
+	"github.com/tkmn0/sylph/pkg/util"
 )
 
+// recordContentTypeHandshake is the content type of dtls handshake record.
+const recordContentTypeHandshake = 22
+
+// defaultHandshakeTimeout limits dtls handshake when ListenerConfig.HandshakeTimeout is not set.
+const defaultHandshakeTimeout = 30 * time.Second
+
 // Listener is dtls listener.
 // This handles udp and dtls.
 type Listener struct {
-	addr       *net.UDPAddr
+	addr       net.Addr
 	Connection chan net.Conn
 	closeCh    chan bool
+	done       chan struct{}
 	cancel     context.CancelFunc
+	lock       sync.Mutex
 	listener   net.Listener
 }
 
@@ -30,82 +40,197 @@ func NewListener() *Listener {
 
 func (l *Listener) obserbeClose() {
 	<-l.closeCh
-	l.closeCh = nil
+	close(l.done)
 	if l.cancel != nil {
 		l.cancel()
 	}
+	l.lock.Lock()
 	if l.listener != nil {
 		l.listener.Close()
 	}
 	l.listener = nil
+	l.lock.Unlock()
 }
 
-func (l *Listener) Listen(c ListenerConfig) {
-	l.closeCh = make(chan bool)
-
-	go l.obserbeClose()
-
-	// Prepare the IP to connect to
-	l.addr = &net.UDPAddr{IP: net.ParseIP(c.Address), Port: c.Port}
+// requestClose never blocks even after the listener closed, since closeCh is buffered.
+func (l *Listener) requestClose() {
+	select {
+	case l.closeCh <- true:
+	default:
+	}
+}
 
-	// Generate a certificate and private key to secure the connection
-	certificate, genErr := selfsign.GenerateSelfSigned()
-	if genErr != nil {
-		log.Fatalln("generate self signed is failed")
+func (l *Listener) Listen(c ListenerConfig) error {
+	var certificates []tls.Certificate
+	var cipherSuites []dtls.CipherSuiteID
+	if c.PSK == nil {
+		certificate, err := l.certificate(c)
+		if err != nil {
+			return err
+		}
+		certificates = []tls.Certificate{*certificate}
+	} else {
+		cipherSuites = util.PSKCipherSuites()
 	}
 
 	// Create parent context to cleanup handshaking connections on exit.
 	ctx, cancel := context.WithCancel(context.Background())
-	l.cancel = cancel
+	timeout := c.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
 
 	// Prepare the configuration of the DTLS connection
 	config := &dtls.Config{
-		Certificates:         []tls.Certificate{certificate},
+		Certificates:         certificates,
+		CipherSuites:         cipherSuites,
 		ExtendedMasterSecret: dtls.RequireExtendedMasterSecret,
+		ClientAuth:           dtls.ClientAuthType(c.ClientAuth),
+		ClientCAs:            c.ClientCAs,
+		PSK:                  c.PSK,
+		PSKIdentityHint:      c.PSKIdentityHint,
 		// Create timeout context for accepted connection.
 		ConnectContextMaker: func() (context.Context, func()) {
-			return context.WithTimeout(ctx, 30*time.Second)
+			return context.WithTimeout(ctx, timeout)
 		},
 	}
 
-	// Listen
-	listener, err := dtls.Listen("udp", l.addr, config)
+	pConn := c.PacketConn
+	if pConn == nil {
+		udpConn, err := l.listenUDP(c)
+		if err != nil {
+			cancel()
+			return err
+		}
+		pConn = udpConn
+	}
+	l.addr = pConn.LocalAddr()
+
+	// PacketMux accepts a connection for each remote address sending dtls handshake,
+	// and the dtls handshake is done in the goroutine of the connection after Admit.
+	// dtls.Listen is not used, since it does the handshake in Accept before Admit can refuse the address.
+	// A remote address is removed when its handshake failed or timed out, or the connection is closed.
+	// The given PacketConn is not closed by Listener.
+	listener := mux.NewPacketMux(pConn, isHandshakeRecord, c.Fallback, c.PacketConn == nil)
+
+	// dtls.Server validates config on every handshake, validate it before accepting.
+	if _, err := dtls.NewListener(listener, config); err != nil {
+		listener.Close()
+		cancel()
+		return err
+	}
+
+	l.lock.Lock()
 	l.listener = listener
+	l.lock.Unlock()
+	l.cancel = cancel
+	l.closeCh = make(chan bool, 1)
+	l.done = make(chan struct{})
 
-	if err != nil {
-		fmt.Println("dtls liten error", err)
-	}
+	go l.obserbeClose()
 
 	go func() {
 		for {
-			// Wait for a connection.
-			if l.listener == nil {
+			// Wait for a connection, Accept returns an error after the listener closed.
+			conn, err := listener.Accept()
+			if err != nil {
+				fmt.Println("listener error:", err.Error())
+				l.requestClose()
 				break
 			}
-			conn, err := l.listener.Accept()
-			defer func() {
-				if conn != nil {
-					err := conn.Close()
-					if err != nil {
-						fmt.Println(err.Error())
-					}
-				}
-			}()
 
-			if err != nil {
-				fmt.Println("listener error:", err.Error())
-				if l.closeCh != nil {
-					l.closeCh <- true
+			release := func(established bool) {}
+			if c.Admit != nil {
+				release, err = c.Admit(conn.RemoteAddr())
+				if err != nil {
+					conn.Close()
+					continue
 				}
-				break
 			}
-			l.Connection <- conn
+			go l.handshake(conn, config, release)
 		}
 	}()
+	return nil
+}
+
+// listenUDP listens on the first address available.
+func (l *Listener) listenUDP(c ListenerConfig) (*net.UDPConn, error) {
+	addrs, err := util.ResolveUDPAddrs(context.Background(), c.Address, c.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn *net.UDPConn
+	for _, addr := range addrs {
+		if c.ReusePort {
+			conn, err = listenUDPReusePort(addr)
+		} else {
+			conn, err = net.ListenUDP("udp", addr)
+		}
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// handshake does dtls handshake on conn, and passes the dtls connection to Connection.
+// release is called after the handshake finished, with whether the connection is passed to Connection.
+func (l *Listener) handshake(conn net.Conn, config *dtls.Config, release func(established bool)) {
+	dtlsConn, err := dtls.Server(conn, config)
+	if err != nil {
+		release(false)
+		// A failed handshake affects only the connection, keep listening.
+		fmt.Println("handshake error:", err.Error())
+		conn.Close()
+		return
+	}
+
+	// dtlsConn is closed by the transport, keep it open when the listener closed.
+	select {
+	case l.Connection <- dtlsConn:
+		release(true)
+	case <-l.done:
+		release(false)
+		dtlsConn.Close()
+	}
+}
+
+// isHandshakeRecord reports whether the packet starts with dtls handshake record.
+func isHandshakeRecord(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == recordContentTypeHandshake
+}
+
+// certificate returns the certificate configured by ListenerConfig.
+func (l *Listener) certificate(c ListenerConfig) (*tls.Certificate, error) {
+	if c.Certificate != nil {
+		return c.Certificate, nil
+	}
+
+	if c.KeyPath != "" || c.CertificatePath != "" {
+		return util.LoadKeyAndCertificate(c.KeyPath, c.CertificatePath)
+	}
+
+	// Generate a certificate and private key to secure the connection
+	certificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		return nil, err
+	}
+	return &certificate, nil
+}
+
+// Addr returns the bound address, nil is returned when not listening.
+func (l *Listener) Addr() net.Addr {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.listener != nil {
+		return l.listener.Addr()
+	}
+	return nil
 }
 
 func (l *Listener) Close() {
 	if l.closeCh != nil {
-		l.closeCh <- true
+		l.requestClose()
 	}
 }
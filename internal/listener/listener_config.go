@@ -1,6 +1,39 @@
 package listener
 
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// ListenerConfig is config for Listener.
+// Address can be a name, an IPv4 address or an IPv6 address. Its addresses are tried in order.
+// Empty Address or "::" listens on both IPv4 and IPv6.
+// Certificate is used for dtls. When Certificate is nil, it is loaded from KeyPath and CertificatePath.
+// When none of them is set, a self-signed certificate is generated.
+// ClientAuth and ClientCAs configure client certificate authentication.
+// When PSK is set, pre-shared key cipher suites are used and certificates are ignored.
+// When PacketConn is set, Listener reads packets from it instead of listening on Address and Port.
+// Fallback is called with packets which are not dtls records of Clients.
+// ReusePort listens with SO_REUSEPORT, which is supported only on Linux.
+// HandshakeTimeout limits dtls handshake of a connection, 30 seconds when it is not set.
+// Admit is called before dtls handshake of a remote address. Returning an error refuses the connection,
+// otherwise the returned function is called after the handshake finished, with whether the connection
+// is passed to Connection.
 type ListenerConfig struct {
-	Address string
-	Port    int
+	Address          string
+	Port             int
+	Certificate      *tls.Certificate
+	KeyPath          string
+	CertificatePath  string
+	ClientAuth       tls.ClientAuthType
+	ClientCAs        *x509.CertPool
+	PSK              func(identity []byte) ([]byte, error)
+	PSKIdentityHint  []byte
+	PacketConn       net.PacketConn
+	Fallback         func(packet []byte, addr net.Addr)
+	ReusePort        bool
+	HandshakeTimeout time.Duration
+	Admit            func(remoteAddr net.Addr) (release func(established bool), err error)
 }
@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package listener
+
+import (
+	"errors"
+	"net"
+)
+
+// listenUDPReusePort is supported only on Linux.
+func listenUDPReusePort(addr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
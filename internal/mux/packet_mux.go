@@ -0,0 +1,280 @@
+// Package mux demultiplexes a net.PacketConn into connections for each remote address.
+//
+// Listener of pion/dtls does dtls handshake inside Accept, and a remote address is known only after
+// the handshake. PacketMux accepts a remote address with its first handshake packet instead,
+// so that Server refuses it by admission control before spending any handshake work on it,
+// and dtls runs over a net.PacketConn given by the user. Packets of a connection are buffered with
+// packetio of pion/transport, which pion/dtls depends on already.
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/transport/packetio"
+)
+
+const (
+	// receiveMTU is the size of buffer to read a packet.
+	receiveMTU = 8192
+	// acceptBacklog is the number of connections waiting for Accept.
+	// Packets from new remote addresses are dropped when the backlog is full.
+	acceptBacklog = 128
+	// bufferLimit is the size of packets buffered for a connection.
+	bufferLimit = 1024 * 1024
+	// dtls records start with a content type in this range, see RFC 7983.
+	dtlsFirstByteMin = 20
+	dtlsFirstByteMax = 63
+)
+
+var errClosed = errors.New("packet mux closed")
+
+// PacketMux demultiplexes net.PacketConn into connections for each remote address.
+// PacketMux is net.Listener accepting connections from new remote addresses.
+type PacketMux struct {
+	pConn        net.PacketConn
+	ownsConn     bool
+	acceptFilter func(packet []byte) bool
+	fallback     func(packet []byte, raddr net.Addr)
+	acceptCh     chan *Conn
+	lock         sync.Mutex
+	conns        map[string]*Conn
+	closed       bool
+	stopped      bool
+	readErr      error
+	done         chan struct{}
+}
+
+// NewPacketMux creates PacketMux and starts reading pConn.
+// acceptFilter reports whether a packet from a new remote address makes a connection to accept.
+// nil acceptFilter accepts no connection, and connections are made by Dial.
+// fallback is called with packets other than dtls records, and packets from remote addresses
+// without a connection which are not accepted. Those packets are dropped when fallback is nil.
+// After PacketMux and all connections are closed, pConn is closed when ownsConn is true,
+// otherwise reading pConn is stopped by setting the read deadline, which is cleared after stopped.
+// The read deadline of pConn is used by PacketMux, and must not be set by the owner while used.
+func NewPacketMux(pConn net.PacketConn, acceptFilter func(packet []byte) bool, fallback func(packet []byte, raddr net.Addr), ownsConn bool) *PacketMux {
+	m := &PacketMux{
+		pConn:        pConn,
+		ownsConn:     ownsConn,
+		acceptFilter: acceptFilter,
+		fallback:     fallback,
+		acceptCh:     make(chan *Conn, acceptBacklog),
+		conns:        map[string]*Conn{},
+		done:         make(chan struct{}),
+	}
+	if !ownsConn {
+		// clear the deadline set by the previous PacketMux.
+		pConn.SetReadDeadline(time.Time{})
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *PacketMux) readLoop() {
+	buffer := make([]byte, receiveMTU)
+	for {
+		n, raddr, err := m.pConn.ReadFrom(buffer)
+		if err != nil {
+			m.lock.Lock()
+			stopped := m.stopped
+			m.lock.Unlock()
+			if stopped {
+				if !m.ownsConn {
+					// give reading back to the owner.
+					m.pConn.SetReadDeadline(time.Time{})
+				}
+				return
+			}
+
+			var netError net.Error
+			if errors.As(err, &netError) && (netError.Timeout() || netError.Temporary()) {
+				continue
+			}
+
+			// pConn was closed by the owner or failed, connections fail with the error.
+			m.lock.Lock()
+			m.readErr = err
+			for _, c := range m.conns {
+				c.buffer.Close()
+			}
+			m.lock.Unlock()
+			m.Close()
+			return
+		}
+
+		if c := m.conn(raddr, buffer[:n]); c != nil {
+			c.buffer.Write(buffer[:n])
+		} else if m.fallback != nil {
+			packet := make([]byte, n)
+			copy(packet, buffer[:n])
+			m.fallback(packet, raddr)
+		}
+	}
+}
+
+// conn returns the connection for raddr. A new connection is made when the packet is accepted.
+// nil is returned for packets other than dtls records.
+func (m *PacketMux) conn(raddr net.Addr, packet []byte) *Conn {
+	if len(packet) == 0 || packet[0] < dtlsFirstByteMin || packet[0] > dtlsFirstByteMax {
+		return nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if c, exists := m.conns[raddr.String()]; exists {
+		return c
+	}
+	if m.closed || m.acceptFilter == nil || !m.acceptFilter(packet) {
+		return nil
+	}
+
+	c := newConn(m, raddr)
+	select {
+	case m.acceptCh <- c:
+		m.conns[raddr.String()] = c
+		return c
+	default:
+		return nil
+	}
+}
+
+// Dial returns the connection for raddr.
+func (m *PacketMux) Dial(raddr net.Addr) (net.Conn, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.stopped {
+		return nil, errClosed
+	}
+	if c, exists := m.conns[raddr.String()]; exists {
+		return c, nil
+	}
+	c := newConn(m, raddr)
+	m.conns[raddr.String()] = c
+	return c, nil
+}
+
+// Accept waits for a connection from a new remote address.
+func (m *PacketMux) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.acceptCh:
+		return c, nil
+	case <-m.done:
+		return nil, errClosed
+	}
+}
+
+// Close stops accepting. Connections are kept open.
+func (m *PacketMux) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	return m.stopIfFinished()
+}
+
+// IsClosed reports whether Close was called.
+func (m *PacketMux) IsClosed() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.closed
+}
+
+func (m *PacketMux) Addr() net.Addr {
+	return m.pConn.LocalAddr()
+}
+
+func (m *PacketMux) removeConn(c *Conn) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.conns[c.raddr.String()] == c {
+		delete(m.conns, c.raddr.String())
+	}
+	return m.stopIfFinished()
+}
+
+// stopIfFinished stops reading pConn after PacketMux and all connections are closed.
+func (m *PacketMux) stopIfFinished() error {
+	if !m.closed || len(m.conns) != 0 || m.stopped {
+		return nil
+	}
+	m.stopped = true
+	if m.ownsConn {
+		return m.pConn.Close()
+	}
+	return m.pConn.SetReadDeadline(time.Now())
+}
+
+// Conn is a connection with a remote address over PacketMux.
+type Conn struct {
+	mux       *PacketMux
+	raddr     net.Addr
+	buffer    *packetio.Buffer
+	closeOnce sync.Once
+}
+
+func newConn(m *PacketMux, raddr net.Addr) *Conn {
+	buffer := packetio.NewBuffer()
+	buffer.SetLimitSize(bufferLimit)
+	return &Conn{
+		mux:    m,
+		raddr:  raddr,
+		buffer: buffer,
+	}
+}
+
+// Read returns the error of the PacketConn when reading it failed, instead of io.EOF.
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.buffer.Read(p)
+	if err == io.EOF {
+		c.mux.lock.Lock()
+		readErr := c.mux.readErr
+		c.mux.lock.Unlock()
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	return c.mux.pConn.WriteTo(p, c.raddr)
+}
+
+func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.buffer.Close()
+		err = c.mux.removeConn(c)
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.mux.pConn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.buffer.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is not supported, writing a packet does not block.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// handshakePacket starts with the content type of dtls handshake record.
+var handshakePacket = []byte{22, 0xfe, 0xfd, 0}
+
+func isHandshake(packet []byte) bool {
+	return len(packet) > 0 && packet[0] == 22
+}
+
+func listenPacket(test *testing.T) net.PacketConn {
+	pConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	return pConn
+}
+
+func dialMux(test *testing.T, m *PacketMux) net.Conn {
+	conn, err := net.Dial("udp", m.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	return conn
+}
+
+// accept waits for a connection accepted by the mux.
+func accept(test *testing.T, m *PacketMux) net.Conn {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		return c
+	case <-time.After(time.Second):
+		test.Fatal("connection should be accepted")
+	}
+	return nil
+}
+
+func connCount(m *PacketMux) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.conns)
+}
+
+func TestPacketMuxAccept(test *testing.T) {
+	fmt.Println("TestPacketMuxAccept")
+	m := NewPacketMux(listenPacket(test), isHandshake, nil, true)
+	defer m.Close()
+	remote := dialMux(test, m)
+	defer remote.Close()
+
+	if _, err := remote.Write(handshakePacket); err != nil {
+		test.Fatal(err)
+	}
+	c := accept(test, m)
+	defer c.Close()
+	if c.RemoteAddr().String() != remote.LocalAddr().String() {
+		test.Errorf("connection should be of %s, got %s", remote.LocalAddr(), c.RemoteAddr())
+	}
+
+	// following packets of the remote address are read by the connection, not accepted again.
+	record := []byte{23, 1, 2, 3}
+	remote.Write(record)
+	buffer := make([]byte, receiveMTU)
+	for _, expected := range [][]byte{handshakePacket, record} {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := c.Read(buffer)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if !bytes.Equal(buffer[:n], expected) {
+			test.Errorf("connection should read %v, got %v", expected, buffer[:n])
+		}
+	}
+
+	c.Write([]byte{23, 4})
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := remote.Read(buffer); err != nil || !bytes.Equal(buffer[:n], []byte{23, 4}) {
+		test.Errorf("remote should read the packet written by the connection, got %v, %v", buffer[:n], err)
+	}
+}
+
+func TestPacketMuxFallback(test *testing.T) {
+	fmt.Println("TestPacketMuxFallback")
+	fallback := make(chan []byte, 2)
+	m := NewPacketMux(listenPacket(test), isHandshake, func(packet []byte, raddr net.Addr) {
+		fallback <- packet
+	}, true)
+	defer m.Close()
+	remote := dialMux(test, m)
+	defer remote.Close()
+
+	// a packet other than dtls, and a dtls record not starting a handshake from a new remote address.
+	for _, packet := range [][]byte{{0, 1}, {23, 1}} {
+		remote.Write(packet)
+		select {
+		case p := <-fallback:
+			if !bytes.Equal(p, packet) {
+				test.Errorf("fallback should receive %v, got %v", packet, p)
+			}
+		case <-time.After(time.Second):
+			test.Fatalf("fallback should receive %v", packet)
+		}
+	}
+	if count := connCount(m); count != 0 {
+		test.Errorf("no connection should be made, got %d", count)
+	}
+}
+
+func TestPacketMuxRemoveConn(test *testing.T) {
+	fmt.Println("TestPacketMuxRemoveConn")
+	m := NewPacketMux(listenPacket(test), isHandshake, nil, true)
+	defer m.Close()
+	remote := dialMux(test, m)
+	defer remote.Close()
+
+	// a remote address failed the handshake is removed, and its next handshake is accepted again.
+	remote.Write(handshakePacket)
+	failed := accept(test, m)
+	failed.Close()
+	if count := connCount(m); count != 0 {
+		test.Fatalf("closed connection should be removed, got %d", count)
+	}
+
+	remote.Write(handshakePacket)
+	c := accept(test, m)
+	if c == failed {
+		test.Error("a new connection should be accepted")
+	}
+	c.Close()
+	if count := connCount(m); count != 0 {
+		test.Errorf("closed connection should be removed, got %d", count)
+	}
+}
+
+func TestPacketMuxBacklog(test *testing.T) {
+	fmt.Println("TestPacketMuxBacklog")
+	m := NewPacketMux(listenPacket(test), isHandshake, nil, true)
+	defer m.Close()
+
+	// remote addresses not accepted are dropped when the backlog is full, not kept in the mux.
+	for i := 0; i < acceptBacklog+8; i++ {
+		remote := dialMux(test, m)
+		defer remote.Close()
+		remote.Write(handshakePacket)
+	}
+	for i := 0; connCount(m) < acceptBacklog; i++ {
+		if i > 100 {
+			test.Fatalf("connections should be made up to the backlog, got %d", connCount(m))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if count := connCount(m); count != acceptBacklog {
+		test.Errorf("connections over the backlog should be dropped, got %d", count)
+	}
+}
+
+func TestPacketMuxReadError(test *testing.T) {
+	fmt.Println("TestPacketMuxReadError")
+	pConn := listenPacket(test)
+	m := NewPacketMux(pConn, isHandshake, nil, false)
+	remote := dialMux(test, m)
+	defer remote.Close()
+	remote.Write(handshakePacket)
+	c := accept(test, m)
+
+	// the owner closed the PacketConn, the connection fails with the error of it.
+	pConn.Close()
+	buffer := make([]byte, receiveMTU)
+	var err error
+	for err == nil {
+		_, err = c.Read(buffer)
+	}
+	var opError *net.OpError
+	if !errors.As(err, &opError) {
+		test.Errorf("connection should fail with the error of PacketConn, got %v", err)
+	}
+	if _, err := m.Accept(); err != errClosed {
+		test.Errorf("Accept should fail after PacketConn closed, got %v", err)
+	}
+}
+
+func TestPacketMuxStop(test *testing.T) {
+	fmt.Println("TestPacketMuxStop")
+	pConn := listenPacket(test)
+	defer pConn.Close()
+	m := NewPacketMux(pConn, isHandshake, nil, false)
+	remote := dialMux(test, m)
+	defer remote.Close()
+	remote.Write(handshakePacket)
+	c := accept(test, m)
+
+	// reading is kept while the connection is open after Close.
+	m.Close()
+	remote.Write([]byte{23, 1})
+	buffer := make([]byte, receiveMTU)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	c.Read(buffer)
+	if n, err := c.Read(buffer); err != nil || !bytes.Equal(buffer[:n], []byte{23, 1}) {
+		test.Fatalf("connection should be read after Close of the mux, got %v, %v", buffer[:n], err)
+	}
+
+	// the PacketConn not owned is given back to the owner after all connections closed.
+	c.Close()
+	time.Sleep(time.Millisecond * 100)
+	remote.Write([]byte{0, 1})
+	pConn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := pConn.ReadFrom(buffer); err != nil || !bytes.Equal(buffer[:n], []byte{0, 1}) {
+		test.Errorf("owner should read the PacketConn after the mux stopped, got %v, %v", buffer[:n], err)
+	}
+}
@@ -2,10 +2,15 @@ package stream
 
 import (
 	"strconv"
+	"sync"
 
 	"github.com/pion/sctp"
+	"github.com/tkmn0/sylph/pkg/channel"
 )
 
+// maxPendingMessages is the maximum number of messages kept until OnMessage or OnData is set.
+const maxPendingMessages = 256
+
 type SctpStream struct {
 	stream             *sctp.Stream
 	onCloseHandler     func()
@@ -15,12 +20,29 @@ type SctpStream struct {
 	dataSendHandler    func(data []byte) (int, error)
 	messageSendHandler func(message string) (int, error)
 	streamCloseHandler func()
+	onOpenHandler      func()
 	isClosed           bool
 	transportId        string
+	label              string
+	protocol           string
+	stateLock          sync.Mutex
+	state              channel.ChannelState
+	opened             chan struct{}
+	closed             chan struct{}
+	handlerLock        sync.Mutex
+	pendingMessages    []string
+	pendingData        [][]byte
+	delivering         bool
 }
 
 func NewSctpStream(stream *sctp.Stream, transportId string) *SctpStream {
-	return &SctpStream{stream: stream, transportId: transportId}
+	return &SctpStream{
+		stream:      stream,
+		transportId: transportId,
+		state:       channel.ChannelStateConnecting,
+		opened:      make(chan struct{}),
+		closed:      make(chan struct{}),
+	}
 }
 
 func (s *SctpStream) id() string {
@@ -37,6 +59,12 @@ func (s *SctpStream) SendMessage(message string) (int, error) {
 }
 
 func (s *SctpStream) Close() {
+	s.stateLock.Lock()
+	if s.state == channel.ChannelStateConnecting || s.state == channel.ChannelStateOpen {
+		s.state = channel.ChannelStateClosing
+	}
+	s.stateLock.Unlock()
+
 	if s.streamCloseHandler != nil {
 		s.streamCloseHandler()
 	}
@@ -46,6 +74,72 @@ func (s *SctpStream) Id() string {
 	return s.id()
 }
 
+// Label returns the label of ChannelConfig the channel opened with.
+func (s *SctpStream) Label() string {
+	return s.label
+}
+
+// Protocol returns the protocol of ChannelConfig the channel opened with.
+func (s *SctpStream) Protocol() string {
+	return s.protocol
+}
+
+// SetLabel sets the label and the protocol of the channel.
+func (s *SctpStream) SetLabel(label string, protocol string) {
+	s.label = label
+	s.protocol = protocol
+}
+
+// State returns the state of the channel.
+func (s *SctpStream) State() channel.ChannelState {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	return s.state
+}
+
+// OnOpen will be called when the channel is acknowledged by the other side.
+func (s *SctpStream) OnOpen(f func()) {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	s.onOpenHandler = f
+}
+
+// SetOpen changes the state from connecting to open, and calls OnOpen.
+func (s *SctpStream) SetOpen() {
+	s.stateLock.Lock()
+	if s.state != channel.ChannelStateConnecting {
+		s.stateLock.Unlock()
+		return
+	}
+	s.state = channel.ChannelStateOpen
+	close(s.opened)
+	handler := s.onOpenHandler
+	s.stateLock.Unlock()
+
+	if handler != nil {
+		handler()
+	}
+}
+
+// Opened is closed when the channel is opened.
+func (s *SctpStream) Opened() <-chan struct{} {
+	return s.opened
+}
+
+// Closed is closed when the channel is closed.
+func (s *SctpStream) Closed() <-chan struct{} {
+	return s.closed
+}
+
+func (s *SctpStream) setClosed() {
+	s.stateLock.Lock()
+	defer s.stateLock.Unlock()
+	if s.state != channel.ChannelStateClosed {
+		s.state = channel.ChannelStateClosed
+		close(s.closed)
+	}
+}
+
 func (s *SctpStream) OnClose(f func()) {
 	s.onCloseHandler = f
 }
@@ -54,12 +148,54 @@ func (s *SctpStream) OnError(f func(err error)) {
 	s.onErrorHandler = f
 }
 
+// OnMessage sets the handler for messages.
+// Messages received before the handler is set, such as those sent by the other side just after
+// the channel opened, are passed to it.
 func (s *SctpStream) OnMessage(f func(message string)) {
+	s.handlerLock.Lock()
 	s.onMessageHandler = f
+	s.deliver()
 }
 
+// OnData sets the handler for data, as well as OnMessage.
 func (s *SctpStream) OnData(f func(data []byte)) {
+	s.handlerLock.Lock()
 	s.onDataHandler = f
+	s.deliver()
+}
+
+// deliver passes pending messages and data to their handlers in order, calling handlers without
+// the lock, so that they can use the channel. This is called with handlerLock held, and releases it.
+// Pending ones without the handler are kept until it is set.
+func (s *SctpStream) deliver() {
+	defer s.handlerLock.Unlock()
+	if s.delivering {
+		// the goroutine delivering passes them.
+		return
+	}
+	s.delivering = true
+	for {
+		if len(s.pendingMessages) > 0 && s.onMessageHandler != nil {
+			m, f := s.pendingMessages[0], s.onMessageHandler
+			s.pendingMessages = s.pendingMessages[1:]
+			s.handlerLock.Unlock()
+			if !s.isClosed {
+				f(m)
+			}
+			s.handlerLock.Lock()
+		} else if len(s.pendingData) > 0 && s.onDataHandler != nil {
+			d, f := s.pendingData[0], s.onDataHandler
+			s.pendingData = s.pendingData[1:]
+			s.handlerLock.Unlock()
+			if !s.isClosed {
+				f(d)
+			}
+			s.handlerLock.Lock()
+		} else {
+			break
+		}
+	}
+	s.delivering = false
 }
 
 // StreamInterface
@@ -83,16 +219,60 @@ func (s *SctpStream) Read(buffer []byte) (int, error, bool) {
 	return l, err, isString
 }
 
+// ReadPayload reads a message with its type, as WebRTC data channels do.
+// Empty messages are sent with a byte of payload, and read as empty.
+func (s *SctpStream) ReadPayload(buffer []byte) (int, PayloadType, error) {
+	l, identifier, err := s.stream.ReadSCTP(buffer)
+	switch identifier {
+	case sctp.PayloadTypeWebRTCDCEP:
+		return l, PayloadTypeDcep, err
+	case sctp.PayloadTypeWebRTCString:
+		return l, PayloadTypeString, err
+	case sctp.PayloadTypeWebRTCStringEmpty:
+		return 0, PayloadTypeString, err
+	case sctp.PayloadTypeWebRTCBinaryEmpty:
+		return 0, PayloadTypeBinary, err
+	}
+	return l, PayloadTypeBinary, err
+}
+
+// WritePayload writes a message with its type, as WebRTC data channels do.
+func (s *SctpStream) WritePayload(buffer []byte, t PayloadType) (int, error) {
+	switch t {
+	case PayloadTypeDcep:
+		return s.stream.WriteSCTP(buffer, sctp.PayloadTypeWebRTCDCEP)
+	case PayloadTypeString:
+		if len(buffer) == 0 {
+			_, err := s.stream.WriteSCTP([]byte{0}, sctp.PayloadTypeWebRTCStringEmpty)
+			return 0, err
+		}
+		return s.stream.WriteSCTP(buffer, sctp.PayloadTypeWebRTCString)
+	}
+	if len(buffer) == 0 {
+		_, err := s.stream.WriteSCTP([]byte{0}, sctp.PayloadTypeWebRTCBinaryEmpty)
+		return 0, err
+	}
+	return s.stream.WriteSCTP(buffer, sctp.PayloadTypeWebRTCBinary)
+}
+
+// SetReliabilityParams changes reliability of the stream.
+func (s *SctpStream) SetReliabilityParams(unordered bool, relType byte, relVal uint32) {
+	s.stream.SetReliabilityParams(unordered, relType, relVal)
+}
+
+// Error passes the error to the handler and closes the stream, which lets the other side know the failure by closing.
+// OnClose is called after OnError, as well as the stream closed by either side.
 func (s *SctpStream) Error(e error) {
 	if s.onErrorHandler != nil {
 		s.onErrorHandler(e)
 	}
-	s.isClosed = true
+	s.CloseStream(true)
 }
 
 func (s *SctpStream) CloseStream(notify bool) {
 	if !s.isClosed {
 		s.isClosed = true
+		s.setClosed()
 		s.stream.Close()
 		if notify && s.onCloseHandler != nil {
 			s.onCloseHandler()
@@ -101,21 +281,35 @@ func (s *SctpStream) CloseStream(notify bool) {
 }
 
 func (s *SctpStream) Message(m string) {
-	if s.onMessageHandler != nil && !s.isClosed {
-		s.onMessageHandler(m)
+	s.handlerLock.Lock()
+	if s.onMessageHandler != nil || len(s.pendingMessages) < maxPendingMessages {
+		s.pendingMessages = append(s.pendingMessages, m)
 	}
+	s.deliver()
 }
 
 func (s *SctpStream) Data(d []byte) {
-	if s.onDataHandler != nil && !s.isClosed {
-		s.onDataHandler(d)
+	s.handlerLock.Lock()
+	if s.onDataHandler != nil || len(s.pendingData) < maxPendingMessages {
+		s.pendingData = append(s.pendingData, d)
 	}
+	s.deliver()
 }
 
 func (s *SctpStream) StreamId() string {
 	return s.id()
 }
 
+// StreamIdentifier returns the sctp stream identifier.
+func (s *SctpStream) StreamIdentifier() uint16 {
+	return s.stream.StreamIdentifier()
+}
+
+// BufferedAmount returns the number of bytes not acknowledged by the other side yet.
+func (s *SctpStream) BufferedAmount() uint64 {
+	return s.stream.BufferedAmount()
+}
+
 func (s *SctpStream) OnDataSendHandler(handler func(data []byte) (int, error)) {
 	s.dataSendHandler = handler
 }
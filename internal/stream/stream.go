@@ -9,7 +9,10 @@ type Stream interface {
 	Read(buffer []byte) (int, error, bool)
 	WriteData(buffer []byte) (int, error)
 	WriteMessage(buffer []byte) (int, error)
+	ReadPayload(buffer []byte) (int, PayloadType, error)
+	WritePayload(buffer []byte, t PayloadType) (int, error)
 	StreamId() string
+	BufferedAmount() uint64
 	OnDataSendHandler(handler func(data []byte) (int, error))
 	OnMessageHandler(handler func(message string) (int, error))
 	OnCloseHandler(handler func())
@@ -7,3 +7,13 @@ const (
 	StreamTypeApp
 	StreamTypeUnKnown
 )
+
+// PayloadType is the type of a message read from or written to a stream without framing of sylph.
+type PayloadType uint8
+
+const (
+	PayloadTypeBinary PayloadType = iota
+	PayloadTypeString
+	// PayloadTypeDcep is a message of Data Channel Establishment Protocol.
+	PayloadTypeDcep
+)
@@ -0,0 +1,118 @@
+package timer
+
+import (
+	"sync"
+	"time"
+)
+
+// Wheel is a hashed timer wheel shared by many timers.
+// A single goroutine advances the wheel every tick while any timer is scheduled,
+// so that idle timers cost neither goroutines nor tickers.
+// Callbacks are called on the goroutine of the Wheel, and must not block.
+type Wheel struct {
+	lock    sync.Mutex
+	tick    time.Duration
+	slots   []map[*Timer]struct{}
+	current int
+	count   int
+	running bool
+}
+
+// Timer is a callback scheduled on Wheel.
+type Timer struct {
+	wheel  *Wheel
+	slot   int
+	rounds int
+	f      func()
+}
+
+// NewWheel creates a Wheel advancing every tick, with the number of slots.
+// Timers are fired with the resolution of tick.
+func NewWheel(tick time.Duration, slots int) *Wheel {
+	w := &Wheel{
+		tick:  tick,
+		slots: make([]map[*Timer]struct{}, slots),
+	}
+	for i := range w.slots {
+		w.slots[i] = map[*Timer]struct{}{}
+	}
+	return w
+}
+
+// AfterFunc calls f after d elapsed.
+func (w *Wheel) AfterFunc(d time.Duration, f func()) *Timer {
+	ticks := int((d + w.tick - 1) / w.tick)
+	if ticks < 1 {
+		ticks = 1
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	t := &Timer{
+		wheel:  w,
+		slot:   (w.current + ticks) % len(w.slots),
+		rounds: (ticks - 1) / len(w.slots),
+		f:      f,
+	}
+	w.slots[t.slot][t] = struct{}{}
+	w.count++
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+	return t
+}
+
+// Stop cancels the timer. false is returned when the timer already fired or stopped.
+func (t *Timer) Stop() bool {
+	w := t.wheel
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if _, exists := w.slots[t.slot][t]; !exists {
+		return false
+	}
+	delete(w.slots[t.slot], t)
+	w.count--
+	return true
+}
+
+// run advances the wheel until no timer is scheduled.
+func (w *Wheel) run() {
+	ticker := time.NewTicker(w.tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !w.advance() {
+			return
+		}
+	}
+}
+
+// advance moves to the next slot and fires its timers.
+// false is returned when no timer is left, and the wheel stops.
+func (w *Wheel) advance() bool {
+	w.lock.Lock()
+	w.current = (w.current + 1) % len(w.slots)
+	expired := []*Timer{}
+	for t := range w.slots[w.current] {
+		if t.rounds > 0 {
+			t.rounds--
+			continue
+		}
+		delete(w.slots[w.current], t)
+		expired = append(expired, t)
+	}
+	w.count -= len(expired)
+	w.lock.Unlock()
+
+	for _, t := range expired {
+		t.f()
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.count == 0 {
+		w.running = false
+		return false
+	}
+	return true
+}
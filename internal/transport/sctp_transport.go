@@ -1,9 +1,15 @@
 package transport
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/pion/dtls/v2"
 	"github.com/pion/logging"
 	"github.com/pion/sctp"
 	"github.com/tkmn0/sylph/internal/engine"
@@ -11,26 +17,64 @@ import (
 	"github.com/tkmn0/sylph/pkg/channel"
 )
 
+// baseStreamIdentifier is the stream identifier of the base stream, the first one opened by Client.
+const baseStreamIdentifier = 0
+
+// ErrHeartbeatTimeout is the reason the transport is lost when heartbeat from the other side timed out.
+var ErrHeartbeatTimeout = errors.New("heartbeat timed out")
+
+// ErrChannelClosed is returned by OpenChannel when the channel or the transport is closed before the channel opened.
+var ErrChannelClosed = errors.New("channel closed before opened")
+
+// ErrUnsupportedProtocolVersion is the reason Client rejects the reply of Server with a protocol version it does not support.
+var ErrUnsupportedProtocolVersion = errors.New("unsupported protocol version")
+
+// rejectionCloseDelay is the duration to wait for Client to close the rejected transport.
+const rejectionCloseDelay = time.Second
+
 type SctpTransport struct {
 	id                     string
+	conn                   net.Conn
 	assosiation            *sctp.Association
 	sctpStreams            map[string]*stream.SctpStream
 	baseStream             stream.Stream
 	onChannelHandler       func(c channel.Channel)
 	onCloseHandler         func()
 	OnTransportInitialized func()
+	OnTransportEstablished func()
+	OnTransportRejected    func(reason string)
+	OnTransportLost        func(err error)
+	OnTransportGoingAway   func()
+	OnAuthenticate         func(ctx context.Context, payload []byte) error
+	AuthPayload            []byte
+	resumptionToken        string
+	DCEP                   bool
 	engines                map[string]*engine.StreamEngine
-	close                  chan bool
-	streamCount            uint16
+	channelConfigs         map[string]channel.ChannelConfig
+	lock                   sync.RWMutex // guards id, baseStream, resumptionToken, maps and closed
+	closed                 bool
+	closing                bool
+	running                bool
+	closeRequested         bool
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	streamIds              *streamIdAllocator
+	protocolLock           sync.RWMutex
 	engineConfig           engine.EngineConfig
+	version                uint8
+	capabilities           engine.Capability
+	errLock                sync.Mutex
+	err                    error
 }
 
 func NewSctpTransport(id string) *SctpTransport {
 	return &SctpTransport{
-		id:          id,
-		sctpStreams: map[string]*stream.SctpStream{},
-		engines:     map[string]*engine.StreamEngine{},
-		streamCount: 0,
+		id:             id,
+		sctpStreams:    map[string]*stream.SctpStream{},
+		engines:        map[string]*engine.StreamEngine{},
+		channelConfigs: map[string]channel.ChannelConfig{},
+		version:        engine.ProtocolVersion,
+		capabilities:   engine.CapabilityChunk,
 	}
 }
 
@@ -40,6 +84,12 @@ func (t *SctpTransport) Init(conn net.Conn, isClient bool, engienConfig engine.E
 		LoggerFactory: logging.NewDefaultLoggerFactory(),
 	}
 	t.engineConfig = engienConfig
+	if t.engineConfig.MaxMessageSize <= 0 {
+		t.engineConfig.MaxMessageSize = engine.DefaultMaxMessageSize
+	}
+	t.conn = conn
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	t.streamIds = newStreamIdAllocator(isClient)
 
 	if isClient {
 		a, err := sctp.Client(config)
@@ -48,7 +98,16 @@ func (t *SctpTransport) Init(conn net.Conn, isClient bool, engienConfig engine.E
 			return err
 		}
 		t.assosiation = a
-		t.openBaseChannel()
+		if !t.DCEP {
+			// the handshake is sent in version 0, which Server of any version reads.
+			t.protocolLock.Lock()
+			t.version = engine.ProtocolVersionLegacy
+			t.protocolLock.Unlock()
+			if err := t.openBaseChannel(); err != nil {
+				a.Close()
+				return err
+			}
+		}
 	} else {
 		a, err := sctp.Server(config)
 		if err != nil {
@@ -58,122 +117,601 @@ func (t *SctpTransport) Init(conn net.Conn, isClient bool, engienConfig engine.E
 		t.assosiation = a
 	}
 
-	t.close = make(chan bool)
+	// closing requested while starting is done now.
+	t.lock.Lock()
+	t.running = true
+	requested := t.closeRequested
+	t.lock.Unlock()
+	if requested {
+		go t.shutdown()
+		return nil
+	}
 
-	go func() {
-		<-t.close
-		t.close = nil
+	if t.DCEP {
+		t.establishDcep(isClient)
+	}
+	return nil
+}
 
-		if t.assosiation != nil {
-			t.assosiation.Close()
+// establishDcep establishes the transport without the transport handshake and heartbeat of sylph,
+// which DCEP peers such as WebRTC do not know. Streams including stream 0 are channels of DCEP.
+// Server calls OnAuthenticate without the payload, and closes the transport when it is rejected.
+func (t *SctpTransport) establishDcep(isClient bool) {
+	if !isClient && t.OnAuthenticate != nil {
+		if err := t.OnAuthenticate(t.ctx, nil); err != nil {
+			t.Close()
+			return
 		}
+	}
+	if t.isCloseRequested() {
+		return
+	}
 
-		if t.onCloseHandler != nil {
-			t.onCloseHandler()
-		}
-	}()
+	if t.OnTransportInitialized != nil {
+		t.OnTransportInitialized()
+	}
+	if t.OnTransportEstablished != nil {
+		t.OnTransportEstablished()
+	}
+}
 
-	return nil
+// shutdown closes the association and calls OnClose.
+func (t *SctpTransport) shutdown() {
+	t.lock.Lock()
+	t.closed = true
+	t.lock.Unlock()
+	t.cancel()
+
+	if t.assosiation != nil {
+		t.assosiation.Close()
+	}
+
+	if t.onCloseHandler != nil {
+		t.onCloseHandler()
+	}
 }
 
 func (t *SctpTransport) AcceptStreamLoop() {
 	for {
 		st, err := t.assosiation.AcceptStream()
 		if err != nil {
-			fmt.Println(t.id, "stream accept error")
+			fmt.Println(t.Id(), "stream accept error")
+			if t.DCEP {
+				// no base stream tracks the association in DCEP mode, it ends with accepting streams.
+				t.onTransportLost(err)
+				t.requestClose()
+			}
 			return
 		}
-		sctpStream := stream.NewSctpStream(st, t.id)
-		e := engine.NewStreamEngine(t.engineConfig)
-		e.OnStreamClosed = t.onStreamClosed
-		e.OnStream = t.onStreamInitialized
-		t.engines[sctpStream.StreamId()] = e
-		e.Run(sctpStream, stream.StreamTypeUnKnown, t.engineConfig, t.id)
+		sctpStream := stream.NewSctpStream(st, t.Id())
+		e := t.newStreamEngine(sctpStream)
+		if t.DCEP {
+			e.RunDcep(sctpStream)
+		} else if st.StreamIdentifier() == baseStreamIdentifier {
+			config, _, _ := t.protocol()
+			e.Run(sctpStream, config)
+		} else {
+			e.RunChannel(sctpStream)
+		}
+	}
+}
+
+func (t *SctpTransport) newStreamEngine(st stream.Stream) *engine.StreamEngine {
+	config, version, capabilities := t.protocol()
+	e := engine.NewStreamEngine(config)
+	e.OnStreamClosed = t.onStreamClosed
+	e.OnStreamError = t.onStreamError
+	e.OnStream = t.onStreamInitialized
+	e.OnGoingAway = t.onGoingAway
+	e.OnDcepOpen = t.onDcepOpen
+	e.OnDcepAck = t.onDcepAck
+	e.SetProtocol(version, capabilities)
+	t.lock.Lock()
+	t.engines[st.StreamId()] = e
+	t.lock.Unlock()
+	return e
+}
+
+// engine returns the engine of the stream.
+func (t *SctpTransport) engine(streamId string) (*engine.StreamEngine, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	e, exists := t.engines[streamId]
+	return e, exists
+}
+
+// streams returns a snapshot of opened streams, to be iterated without the lock.
+func (t *SctpTransport) streams() []*stream.SctpStream {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	streams := make([]*stream.SctpStream, 0, len(t.sctpStreams))
+	for _, s := range t.sctpStreams {
+		streams = append(streams, s)
 	}
+	return streams
 }
 
-func (t *SctpTransport) openBaseChannel() {
+func (t *SctpTransport) setStream(streamId string, st *stream.SctpStream) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sctpStreams[streamId] = st
+}
+
+func (t *SctpTransport) setChannelConfig(streamId string, c channel.ChannelConfig) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.channelConfigs[streamId] = c
+}
+
+// openBaseChannel opens the base stream, and sends the initialize message with AuthPayload.
+func (t *SctpTransport) openBaseChannel() error {
 	c := channel.ChannelConfig{
 		Unordered:        false,
 		ReliabliityType:  channel.ReliabilityTypeReliable,
 		ReliabilityValue: 0,
 	}
-	err := t.openChannel(c, stream.StreamTypeBase)
+	st, err := t.openChannel(c)
 	if err != nil {
 		fmt.Println("error to open base stream", err)
+		return err
 	}
+
+	t.setBaseStream(st)
+	config, _, capabilities := t.protocol()
+	return t.sendInitializeMessage(st, engine.InitializeMessage{
+		StreamType:              uint8(stream.StreamTypeBase),
+		TransportId:             t.Id(),
+		AuthPayload:             t.AuthPayload,
+		ResumptionToken:         t.ResumptionToken(),
+		Version:                 engine.ProtocolVersion,
+		Capabilities:            capabilities,
+		HeartbeatRateMillisec:   uint32(config.HeartbeatRateMillisec),
+		TimeOutDurationMilliSec: uint32(config.TimeOutDurationMilliSec),
+		MaxMessageSize:          uint32(config.MaxMessageSize),
+	})
 }
 
-func (t *SctpTransport) openChannel(c channel.ChannelConfig, streamType stream.StreamType) error {
-	st, err := t.assosiation.OpenStream(t.streamCount, sctp.PayloadTypeWebRTCBinary)
+func (t *SctpTransport) openChannel(c channel.ChannelConfig) (*stream.SctpStream, error) {
+	st, err := t.openStream()
+	if err != nil {
+		fmt.Println("error open stream", err)
+		return nil, err
+	}
 	st.SetReliabilityParams(c.Unordered, byte(c.ReliabliityType), c.ReliabilityValue)
-	t.streamCount++
 
+	sctpStream := stream.NewSctpStream(st, t.Id())
+	e := t.newStreamEngine(sctpStream)
+	if st.StreamIdentifier() == baseStreamIdentifier {
+		config, _, _ := t.protocol()
+		e.Run(sctpStream, config)
+	} else {
+		e.RunChannel(sctpStream)
+	}
+	return sctpStream, nil
+}
+
+// openStream opens a sctp stream with an identifier allocated for this side.
+// A closed stream remains in the association until the other side resets it,
+// so the next identifier is tried when the allocated one is still there.
+func (t *SctpTransport) openStream() (*sctp.Stream, error) {
+	skipped := []uint16{}
+	defer func() {
+		for _, id := range skipped {
+			t.streamIds.release(id)
+		}
+	}()
+
+	for {
+		id, err := t.streamIds.allocate()
+		if err != nil {
+			return nil, err
+		}
+		st, err := t.assosiation.OpenStream(id, sctp.PayloadTypeWebRTCBinary)
+		if err == nil {
+			return st, nil
+		}
+		skipped = append(skipped, id)
+	}
+}
+
+// OpenChannel opens a channel, and returns it after the other side acknowledged it.
+// When ctx is done before that, the channel is closed and the error of ctx is returned.
+func (t *SctpTransport) OpenChannel(ctx context.Context, c channel.ChannelConfig) (channel.Channel, error) {
+	st, err := t.openAppChannel(c, false)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-st.Opened():
+		return st, nil
+	case <-st.Closed():
+		return nil, ErrChannelClosed
+	case <-t.ctx.Done():
+		return nil, ErrChannelClosed
+	case <-ctx.Done():
+		st.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// ReopenChannels opens channels again after reconnection.
+// They are passed to OnChannel when opened, since they are not returned by OpenChannel.
+func (t *SctpTransport) ReopenChannels(configs []channel.ChannelConfig) {
+	for _, c := range configs {
+		if _, err := t.openAppChannel(c, true); err != nil {
+			fmt.Println("reopen channel error", err)
+		}
+	}
+}
+
+// openAppChannel opens a channel with the initialize message, or DATA_CHANNEL_OPEN in DCEP mode.
+// When notify is true, the channel is passed to OnChannel when opened.
+func (t *SctpTransport) openAppChannel(c channel.ChannelConfig, notify bool) (*stream.SctpStream, error) {
+	if t.DCEP {
+		return t.openDcepChannel(c, notify)
+	}
+
+	st, err := t.openChannel(c)
+	if err != nil {
+		return nil, err
+	}
+	t.setChannelConfig(st.StreamId(), c)
+	st.SetLabel(c.Label, c.Protocol)
+	if notify {
+		st.OnOpen(func() {
+			t.notifyChannel(st)
+		})
+	}
+
+	err = t.sendInitializeMessage(st, engine.InitializeMessage{
+		StreamType:  uint8(stream.StreamTypeApp),
+		TransportId: t.Id(),
+		Label:       c.Label,
+		Protocol:    c.Protocol,
+	})
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// openDcepChannel opens a channel with DATA_CHANNEL_OPEN.
+// The channel is ordered and reliable until DATA_CHANNEL_ACK is received, as RFC 8832 requires.
+func (t *SctpTransport) openDcepChannel(c channel.ChannelConfig, notify bool) (*stream.SctpStream, error) {
+	st, err := t.openStream()
 	if err != nil {
 		fmt.Println("error open stream", err)
-		return err
+		return nil, err
 	}
 
-	sctpStream := stream.NewSctpStream(st, t.id)
-	e := engine.NewStreamEngine(t.engineConfig)
-	e.OnStreamClosed = t.onStreamClosed
-	e.OnStream = t.onStreamInitialized
-	t.engines[sctpStream.StreamId()] = e
-	e.Run(sctpStream, streamType, t.engineConfig, t.id)
-	return nil
+	sctpStream := stream.NewSctpStream(st, t.Id())
+	sctpStream.SetLabel(c.Label, c.Protocol)
+	if notify {
+		sctpStream.OnOpen(func() {
+			t.notifyChannel(sctpStream)
+		})
+	}
+	t.setChannelConfig(sctpStream.StreamId(), c)
+	e := t.newStreamEngine(sctpStream)
+	e.RunDcep(sctpStream)
+	err = e.SendDcepOpen(sctpStream, engine.NewDcepOpenMessage(c.Unordered, byte(c.ReliabliityType), c.ReliabilityValue, c.Label, c.Protocol))
+	if err != nil {
+		sctpStream.Close()
+		return nil, err
+	}
+	return sctpStream, nil
+}
+
+// onDcepOpen accepts a channel opened by the other side with DATA_CHANNEL_OPEN.
+func (t *SctpTransport) onDcepOpen(st stream.Stream, message engine.DcepOpenMessage) {
+	sctpStream := t.changeStreamToSctpStream(st)
+	if sctpStream == nil {
+		return
+	}
+	sctpStream.SetLabel(message.Label, message.Protocol)
+	t.setStream(st.StreamId(), sctpStream)
+
+	if e, exists := t.engine(st.StreamId()); exists {
+		e.SendDcepAck(st)
+	}
+	sctpStream.SetReliabilityParams(message.Unordered(), message.ReliabilityType(), message.ReliabilityParameter)
+	sctpStream.SetOpen()
+	t.notifyChannel(st)
 }
 
-func (t *SctpTransport) OpenChannel(c channel.ChannelConfig) error {
-	return t.openChannel(c, stream.StreamTypeApp)
+// onDcepAck handles DATA_CHANNEL_ACK for the channel opened by this side.
+func (t *SctpTransport) onDcepAck(st stream.Stream) {
+	sctpStream := t.changeStreamToSctpStream(st)
+	if sctpStream == nil {
+		return
+	}
+	t.lock.Lock()
+	c, exists := t.channelConfigs[st.StreamId()]
+	_, acked := t.sctpStreams[st.StreamId()]
+	if !exists || acked {
+		t.lock.Unlock()
+		return
+	}
+	t.sctpStreams[st.StreamId()] = sctpStream
+	t.lock.Unlock()
+	sctpStream.SetReliabilityParams(c.Unordered, byte(c.ReliabliityType), c.ReliabilityValue)
+	sctpStream.SetOpen()
+}
+
+func (t *SctpTransport) sendInitializeMessage(st stream.Stream, m engine.InitializeMessage) error {
+	if e, exists := t.engine(st.StreamId()); exists {
+		return e.SendInitializeMessage(st, m)
+	}
+	return nil
 }
 
 func (t *SctpTransport) onStreamClosed(s stream.Stream) {
+	isBaseStream := t.isBaseStream(s)
+
+	s.CloseStream(!isBaseStream)
 
-	s.CloseStream(t.baseStream.StreamId() != s.StreamId())
+	// closed by either side, not to be opened again.
+	// Configs of the lost transport are taken by OnTransportLost before channels are closed.
+	t.lock.Lock()
+	delete(t.channelConfigs, s.StreamId())
+	e, exists := t.engines[s.StreamId()]
+	delete(t.engines, s.StreamId())
+	delete(t.sctpStreams, s.StreamId())
+	t.lock.Unlock()
 
-	if t.baseStream.StreamId() == s.StreamId() {
-		if t.close != nil {
-			t.close <- true
+	if isBaseStream {
+		if exists && e.TimedOut() {
+			t.onTransportLost(ErrHeartbeatTimeout)
 		}
+		t.requestClose()
 	}
 
-	if e, exists := t.engines[s.StreamId()]; exists {
+	if exists {
 		e.Stop()
-		delete(t.engines, s.StreamId())
 	}
 
-	delete(t.sctpStreams, s.StreamId())
+	if sctpStream := t.changeStreamToSctpStream(s); sctpStream != nil {
+		t.streamIds.release(sctpStream.StreamIdentifier())
+	}
+}
+
+// onStreamError closes the transport when the base stream failed, the association is lost then.
+// Errors of other streams are passed to their channels only.
+func (t *SctpTransport) onStreamError(s stream.Stream, err error) {
+	if t.isBaseStream(s) {
+		t.onTransportLost(err)
+		t.requestClose()
+	}
+}
+
+// onTransportLost calls OnTransportLost once, when the transport closes without Close of either side.
+// Channels opened by this side are kept in ChannelConfigs to be opened again after reconnection.
+func (t *SctpTransport) onTransportLost(err error) {
+	t.lock.Lock()
+	if t.closing || t.closed {
+		t.lock.Unlock()
+		return
+	}
+	t.closing = true
+	t.lock.Unlock()
+
+	t.setErr(err)
+	if t.OnTransportLost != nil {
+		t.OnTransportLost(err)
+	}
 }
 
 func (t *SctpTransport) onStreamInitialized(st stream.Stream, message engine.InitializeMessage) {
-	t.sctpStreams[st.StreamId()] = t.changeStreamToSctpStream(st)
+	t.setStream(st.StreamId(), t.changeStreamToSctpStream(st))
 	streamType := stream.StreamType(message.StreamType)
 	if streamType == stream.StreamTypeBase {
+		// server recieved, reply after authentication
+		t.lock.Lock()
 		t.baseStream = st
+		t.resumptionToken = message.ResumptionToken
+		t.lock.Unlock()
+		t.negotiate(message)
+		go t.authenticate(st, message.AuthPayload)
 	} else if streamType == stream.StreamTypeApp {
-		if t.onChannelHandler != nil {
-			sctpStream := t.changeStreamToSctpStream(st)
-			if sctpStream != nil {
-				t.onChannelHandler(sctpStream)
-			}
+		// app stream opened by the other side
+		if sctpStream := t.changeStreamToSctpStream(st); sctpStream != nil {
+			sctpStream.SetLabel(message.Label, message.Protocol)
+			sctpStream.SetOpen()
 		}
+		t.sendInitializeMessage(st, engine.InitializeMessage{
+			StreamType:  uint8(stream.StreamTypeUnKnown),
+			TransportId: t.Id(),
+		})
+		t.notifyChannel(st)
 	} else {
-		// client recieved
-		if t.id == "" {
-			t.id = message.TransportId + "-client"
-			// id not configurated, this is base stream
-			if t.OnTransportInitialized != nil {
-				t.OnTransportInitialized()
-			}
-			t.baseStream = st
-		} else {
-			// id is already configurated, this is app stream
-			if t.onChannelHandler != nil {
-				sctpStream := t.changeStreamToSctpStream(st)
-				if sctpStream != nil {
-					t.onChannelHandler(sctpStream)
-				}
+		// reply for the stream opened by this side
+		if t.isBaseStream(st) {
+			t.onBaseStreamReplied(message)
+		} else if sctpStream := t.changeStreamToSctpStream(st); sctpStream != nil {
+			sctpStream.SetOpen()
+		}
+	}
+}
+
+// negotiate decides the protocol version, capabilities and config from the ones of Client.
+// Heartbeat rate and timeout of Server are enforced, and the max message size is the smaller one.
+// The reply of the base stream is sent with the negotiated version, JSON for Clients of ProtocolVersionLegacy.
+func (t *SctpTransport) negotiate(message engine.InitializeMessage) {
+	config, _, capabilities := t.protocol()
+	version := message.Version
+	if version > engine.ProtocolVersion {
+		version = engine.ProtocolVersion
+	}
+	if message.MaxMessageSize > 0 && int(message.MaxMessageSize) < config.MaxMessageSize {
+		config.MaxMessageSize = int(message.MaxMessageSize)
+	}
+	t.setProtocol(config, version, message.Capabilities&capabilities)
+}
+
+// reject replies the reason to Client, and closes the transport after Client closed it.
+func (t *SctpTransport) reject(st stream.Stream, reason string) {
+	t.sendInitializeMessage(st, engine.InitializeMessage{
+		StreamType: uint8(stream.StreamTypeUnKnown),
+		Error:      reason,
+	})
+	time.AfterFunc(rejectionCloseDelay, t.Close)
+}
+
+// authenticate calls OnAuthenticate and replies the result to Client.
+func (t *SctpTransport) authenticate(st stream.Stream, payload []byte) {
+	if t.OnAuthenticate != nil {
+		if err := t.OnAuthenticate(t.ctx, payload); err != nil {
+			reason := err.Error()
+			if reason == "" {
+				reason = "rejected"
 			}
+			t.reject(st, reason)
+			return
+		}
+	}
+	if t.isCloseRequested() {
+		// closed while authenticating, such as by the handshake deadline of Server.
+		return
+	}
+
+	// The handler may resume the transport, which changes id and ResumptionToken sent in the reply.
+	if t.OnTransportInitialized != nil {
+		t.OnTransportInitialized()
+	}
+	defer func() {
+		// notify after reply, so that Client accepts channels opened by the handler.
+		if t.OnTransportEstablished != nil {
+			t.OnTransportEstablished()
+		}
+	}()
+	config, version, capabilities := t.protocol()
+	t.sendInitializeMessage(st, engine.InitializeMessage{
+		StreamType:              uint8(stream.StreamTypeUnKnown),
+		TransportId:             t.Id(),
+		ResumptionToken:         t.ResumptionToken(),
+		Version:                 version,
+		Capabilities:            capabilities,
+		HeartbeatRateMillisec:   uint32(config.HeartbeatRateMillisec),
+		TimeOutDurationMilliSec: uint32(config.TimeOutDurationMilliSec),
+		MaxMessageSize:          uint32(config.MaxMessageSize),
+	})
+}
+
+// onBaseStreamReplied handles the reply of Server for the base stream.
+func (t *SctpTransport) onBaseStreamReplied(message engine.InitializeMessage) {
+	if message.Error != "" {
+		if t.OnTransportRejected != nil {
+			t.OnTransportRejected(message.Error)
+		}
+		return
+	}
+	if message.Version > engine.ProtocolVersion {
+		if t.OnTransportRejected != nil {
+			t.OnTransportRejected(fmt.Sprintf("%v %d", ErrUnsupportedProtocolVersion, message.Version))
+		}
+		return
+	}
+
+	// adopt the config of Server, the other side expects heartbeat at its rate.
+	config, _, _ := t.protocol()
+	if message.HeartbeatRateMillisec > 0 {
+		config.HeartbeatRateMillisec = time.Duration(message.HeartbeatRateMillisec)
+	}
+	if message.TimeOutDurationMilliSec > 0 {
+		config.TimeOutDurationMilliSec = time.Duration(message.TimeOutDurationMilliSec)
+	}
+	if message.MaxMessageSize > 0 {
+		config.MaxMessageSize = int(message.MaxMessageSize)
+	}
+	t.setProtocol(config, message.Version, message.Capabilities)
+
+	t.lock.Lock()
+	initialized := t.id != ""
+	if !initialized {
+		t.id = message.TransportId + "-client"
+		t.resumptionToken = message.ResumptionToken
+	}
+	t.lock.Unlock()
+	if !initialized {
+		if t.OnTransportInitialized != nil {
+			t.OnTransportInitialized()
+		}
+	}
+}
+
+// protocol returns the config, the protocol version and capabilities negotiated with the other side.
+func (t *SctpTransport) protocol() (engine.EngineConfig, uint8, engine.Capability) {
+	t.protocolLock.RLock()
+	defer t.protocolLock.RUnlock()
+	return t.engineConfig, t.version, t.capabilities
+}
+
+// setProtocol changes the negotiated ones, and applies them to running engines.
+func (t *SctpTransport) setProtocol(config engine.EngineConfig, version uint8, capabilities engine.Capability) {
+	t.protocolLock.Lock()
+	t.engineConfig = config
+	t.version = version
+	t.capabilities = capabilities
+	t.protocolLock.Unlock()
+
+	t.lock.RLock()
+	engines := make([]*engine.StreamEngine, 0, len(t.engines))
+	for _, e := range t.engines {
+		engines = append(engines, e)
+	}
+	t.lock.RUnlock()
+	for _, e := range engines {
+		e.SetConfig(config)
+		e.SetProtocol(version, capabilities)
+	}
+}
+
+// NegotiatedConfig returns the config and the protocol version negotiated in the transport handshake.
+// Before the handshake, the config of this side is returned.
+func (t *SctpTransport) NegotiatedConfig() (engine.EngineConfig, uint8) {
+	config, version, _ := t.protocol()
+	return config, version
+}
+
+// GoAway notifies the other side that this side is shutting down.
+// The transport closed by the other side after this is not lost.
+func (t *SctpTransport) GoAway() {
+	t.lock.Lock()
+	t.closing = true
+	t.lock.Unlock()
+
+	if baseStream := t.getBaseStream(); baseStream != nil {
+		if e, exists := t.engine(baseStream.StreamId()); exists {
+			e.SendGoingAwayMessage(baseStream)
+		}
+	}
+}
+
+func (t *SctpTransport) onGoingAway(st stream.Stream) {
+	if t.OnTransportGoingAway != nil {
+		t.OnTransportGoingAway()
+	}
+}
+
+// BufferedAmount returns the number of bytes not acknowledged by the other side yet in all streams.
+func (t *SctpTransport) BufferedAmount() uint64 {
+	var amount uint64
+	if baseStream := t.getBaseStream(); baseStream != nil {
+		amount += baseStream.BufferedAmount()
+	}
+	for _, s := range t.streams() {
+		amount += s.BufferedAmount()
+	}
+	return amount
+}
+
+func (t *SctpTransport) notifyChannel(st stream.Stream) {
+	if t.onChannelHandler != nil {
+		sctpStream := t.changeStreamToSctpStream(st)
+		if sctpStream != nil {
+			t.onChannelHandler(sctpStream)
 		}
 	}
 }
@@ -188,8 +726,50 @@ func (t *SctpTransport) changeStreamToSctpStream(i interface{}) *stream.SctpStre
 }
 
 func (t *SctpTransport) Id() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	return t.id
 }
+
+// SetId changes id, used by Server when the transport resumed the previous one.
+func (t *SctpTransport) SetId(id string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.id = id
+}
+
+// ResumptionToken returns the token to resume the transport.
+// In Server, this is the token sent by Client until OnTransportInitialized replaces it.
+func (t *SctpTransport) ResumptionToken() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.resumptionToken
+}
+
+// SetResumptionToken sets the token sent to the other side in the transport handshake.
+func (t *SctpTransport) SetResumptionToken(token string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.resumptionToken = token
+}
+
+func (t *SctpTransport) getBaseStream() stream.Stream {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.baseStream
+}
+
+func (t *SctpTransport) setBaseStream(st stream.Stream) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.baseStream = st
+}
+
+func (t *SctpTransport) isBaseStream(st stream.Stream) bool {
+	baseStream := t.getBaseStream()
+	return baseStream != nil && baseStream.StreamId() == st.StreamId()
+}
+
 func (t *SctpTransport) OnChannel(handler func(channel channel.Channel)) {
 	t.onChannelHandler = handler
 }
@@ -199,6 +779,8 @@ func (t *SctpTransport) OnClose(handler func()) {
 }
 
 func (t *SctpTransport) Channel(id string) channel.Channel {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
 	if channel, exists := t.sctpStreams[id]; exists {
 		return channel
 	} else {
@@ -208,20 +790,99 @@ func (t *SctpTransport) Channel(id string) channel.Channel {
 
 func (t *SctpTransport) SetConfig() {}
 
+// ChannelConfigs returns configs of channels opened by this side and not closed by either side.
+func (t *SctpTransport) ChannelConfigs() []channel.ChannelConfig {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	configs := []channel.ChannelConfig{}
+	for _, c := range t.channelConfigs {
+		configs = append(configs, c)
+	}
+	return configs
+}
+
 func (t *SctpTransport) Close() {
-	for _, s := range t.sctpStreams {
+	t.lock.Lock()
+	t.closing = true
+	t.lock.Unlock()
+
+	for _, s := range t.streams() {
 		s.Close()
 	}
 
-	if t.baseStream != nil {
-		t.baseStream.Close()
+	if baseStream := t.getBaseStream(); baseStream != nil {
+		baseStream.Close()
 	}
 
-	if t.close != nil {
-		t.close <- true
+	t.requestClose()
+}
+
+// requestClose closes the transport once in background, so that this never blocks.
+// Before Init started the association, it is closed at the end of Init.
+func (t *SctpTransport) requestClose() {
+	t.lock.Lock()
+	if t.closeRequested {
+		t.lock.Unlock()
+		return
 	}
+	t.closeRequested = true
+	running := t.running
+	t.lock.Unlock()
+	if running {
+		go t.shutdown()
+	}
+}
+
+// Err returns the reason the transport is lost, ErrHeartbeatTimeout when heartbeat timed out,
+// or the error of the association.
+// nil is returned while the transport is open, or when it was closed by either side.
+func (t *SctpTransport) Err() error {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	return t.err
+}
+
+func (t *SctpTransport) setErr(err error) {
+	t.errLock.Lock()
+	defer t.errLock.Unlock()
+	t.err = err
+}
+
+// isCloseRequested reports whether the transport is closed or closing.
+func (t *SctpTransport) isCloseRequested() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.closeRequested
 }
 
 func (t *SctpTransport) IsClosed() bool {
-	return t.close == nil
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.closed
+}
+
+func (t *SctpTransport) RemoteAddr() net.Addr {
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.RemoteAddr()
+}
+
+// PeerCertificates returns certificates presented by the other side in dtls handshake,
+// or the error of parsing them.
+func (t *SctpTransport) PeerCertificates() ([]*x509.Certificate, error) {
+	dtlsConn, ok := t.conn.(*dtls.Conn)
+	if !ok {
+		return nil, nil
+	}
+
+	certificates := []*x509.Certificate{}
+	for _, raw := range dtlsConn.ConnectionState().PeerCertificates {
+		certificate, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
 }
@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// ErrStreamIdExhausted is returned when all stream identifiers of this side are in use.
+var ErrStreamIdExhausted = errors.New("sctp stream identifiers are exhausted")
+
+// streamIdAllocator allocates sctp stream identifiers for streams opened by this side.
+// As WebRTC does, Client uses even identifiers and Server uses odd ones,
+// so that streams opened by both sides never collide.
+// Identifiers of closed streams are reused.
+type streamIdAllocator struct {
+	lock  sync.Mutex
+	first uint16
+	next  uint16
+	used  map[uint16]bool
+}
+
+func newStreamIdAllocator(isClient bool) *streamIdAllocator {
+	var first uint16 = 1
+	if isClient {
+		first = 0
+	}
+	return &streamIdAllocator{
+		first: first,
+		next:  first,
+		used:  map[uint16]bool{},
+	}
+}
+
+// allocate returns the lowest identifier not in use.
+func (a *streamIdAllocator) allocate() (uint16, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	// 65535 is not used as a stream identifier.
+	for id := int(a.next); id < math.MaxUint16; id += 2 {
+		if !a.used[uint16(id)] {
+			a.used[uint16(id)] = true
+			a.next = uint16(id) + 2
+			return uint16(id), nil
+		}
+	}
+	return 0, ErrStreamIdExhausted
+}
+
+// release makes id available again. Identifiers not allocated by this side are ignored.
+func (a *streamIdAllocator) release(id uint16) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.used[id] {
+		return
+	}
+	delete(a.used, id)
+	if id < a.next {
+		a.next = id
+	}
+}
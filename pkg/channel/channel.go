@@ -5,6 +5,10 @@ type Channel interface {
 	SendMessage(message string) (int, error)
 	Close()
 	Id() string
+	Label() string
+	Protocol() string
+	State() ChannelState
+	OnOpen(f func())
 	OnClose(f func())
 	OnError(f func(err error))
 	OnMessage(f func(message string))
@@ -11,8 +11,13 @@ const (
 	ReliabilityTypeTimed
 )
 
+// ChannelConfig is config to open a Channel.
+// Label and Protocol are sent to the other side, and returned by Channel.Label and Channel.Protocol
+// on both sides, so that the other side can tell what the Channel is for.
 type ChannelConfig struct {
 	Unordered        bool
 	ReliabliityType  ReliabilityType
 	ReliabilityValue uint32
+	Label            string
+	Protocol         string
 }
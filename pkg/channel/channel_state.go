@@ -0,0 +1,29 @@
+package channel
+
+// ChannelState is the state of a Channel.
+type ChannelState int
+
+const (
+	// ChannelStateConnecting is the state until the other side acknowledges the Channel.
+	ChannelStateConnecting ChannelState = iota
+	// ChannelStateOpen is the state the Channel can send messages.
+	ChannelStateOpen
+	// ChannelStateClosing is the state after Close is called until the Channel is closed.
+	ChannelStateClosing
+	// ChannelStateClosed is the state after the Channel is closed by either side.
+	ChannelStateClosed
+)
+
+func (s ChannelState) String() string {
+	switch s {
+	case ChannelStateConnecting:
+		return "Connecting"
+	case ChannelStateOpen:
+		return "Open"
+	case ChannelStateClosing:
+		return "Closing"
+	case ChannelStateClosed:
+		return "Closed"
+	}
+	return ""
+}
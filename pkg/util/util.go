@@ -1,8 +1,9 @@
-// Package util provides auxiliary utilities used in examples
+// Package util provides auxiliary utilities used in sylph and examples
 package util
 
 import (
 	"bufio"
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/rsa"
@@ -16,7 +17,10 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/pion/dtls/v2"
 )
 
 const bufSize = 8192
@@ -144,3 +148,60 @@ func LoadCertificate(path string) (*tls.Certificate, error) {
 
 	return &certificate, nil
 }
+
+// SplitHostPort splits "host:port" into host and port. The port can be a service name.
+func SplitHostPort(addr string) (string, int, error) {
+	host, service, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, err
+	}
+
+	port, err := strconv.Atoi(service)
+	if err != nil {
+		port, err = net.LookupPort("udp", service)
+		if err != nil {
+			return "", 0, err
+		}
+	}
+	return host, port, nil
+}
+
+// ResolveUDPAddrs resolves host to udp addresses with port, in the order of the resolver.
+// host can be a name, an IPv4 address or an IPv6 address with or without brackets.
+// Empty host returns the unspecified address, which listens on both IPv4 and IPv6.
+func ResolveUDPAddrs(ctx context.Context, host string, port int) ([]*net.UDPAddr, error) {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "" {
+		return []*net.UDPAddr{{Port: port}}, nil
+	}
+
+	// IPv6 address may have a zone, e.g. "fe80::1%eth0"
+	ipHost, zone := host, ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		ipHost, zone = host[:i], host[i+1:]
+	}
+	if ip := net.ParseIP(ipHost); ip != nil {
+		return []*net.UDPAddr{{IP: ip, Port: port, Zone: zone}}, nil
+	}
+
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]*net.UDPAddr, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		addrs = append(addrs, &net.UDPAddr{IP: ipAddr.IP, Port: port, Zone: ipAddr.Zone})
+	}
+	return addrs, nil
+}
+
+// PSKCipherSuites returns cipher suites used in pre-shared key mode of Client and Server.
+// Default cipher suites of dtls include no PSK cipher suite.
+func PSKCipherSuites() []dtls.CipherSuiteID {
+	return []dtls.CipherSuiteID{
+		dtls.TLS_PSK_WITH_AES_128_GCM_SHA256,
+		dtls.TLS_PSK_WITH_AES_128_CCM,
+		dtls.TLS_PSK_WITH_AES_128_CCM_8,
+	}
+}
@@ -0,0 +1,84 @@
+package sylph
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/tkmn0/sylph/pkg/channel"
+)
+
+const (
+	defaultInitialBackoff = time.Millisecond * 500
+	defaultMaxBackoff     = time.Second * 30
+)
+
+// backoff returns the duration to wait before the attempt. attempt starts from 0.
+func (p ReconnectPolicy) backoff(attempt int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	backoff := initial
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+
+	if p.Jitter > 0 {
+		backoff += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(backoff))
+	}
+	return backoff
+}
+
+// reconnect dials Server again with ReconnectPolicy.
+// After reconnected, channels in channelConfigs are opened again on the new transport.
+func (c *Client) reconnect(ct *sessionTransport, channelConfigs []channel.ChannelConfig) {
+	c.lock.RLock()
+	tc := c.config
+	closeCh := c.closeCh
+	c.lock.RUnlock()
+	policy := tc.Reconnect
+	c.setConnectionState(Reconnecting, nil)
+
+	var err error
+	for attempt := 0; policy.MaxAttempts == 0 || attempt < policy.MaxAttempts; attempt++ {
+		select {
+		case <-time.After(policy.backoff(attempt)):
+		case <-closeCh:
+			ct.notifyClosed()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), tc.handshakeTimeout())
+		conn, state, dialErr := c.dial(ctx, cancel)
+		cancel()
+		if dialErr != nil {
+			err = dialErr
+			if state == AuthFailed || state == ErrorToReady {
+				// retrying will not help
+				c.setConnectionState(state, err)
+				ct.notifyClosed()
+				return
+			}
+			continue
+		}
+
+		if initErr := c.startTransport(conn, ct, channelConfigs, nil); initErr != nil {
+			err = &AssociationError{Err: initErr}
+			conn.Close()
+			continue
+		}
+		return
+	}
+
+	c.setConnectionState(TimeOut, err)
+	ct.notifyClosed()
+}
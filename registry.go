@@ -0,0 +1,71 @@
+package sylph
+
+import "sync"
+
+// transportRegistry holds Transports of Server by id.
+// Transports are removed when closed.
+type transportRegistry struct {
+	lock       sync.RWMutex
+	transports map[string]*sessionTransport
+	removedCh  chan struct{}
+}
+
+func newTransportRegistry() *transportRegistry {
+	return &transportRegistry{
+		transports: map[string]*sessionTransport{},
+		removedCh:  make(chan struct{}),
+	}
+}
+
+func (r *transportRegistry) add(t *sessionTransport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.transports[t.Id()] = t
+}
+
+func (r *transportRegistry) remove(t *sessionTransport) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.transports[t.Id()] == t {
+		delete(r.transports, t.Id())
+		close(r.removedCh)
+		r.removedCh = make(chan struct{})
+	}
+}
+
+// removed returns a channel closed when a Transport is removed next.
+func (r *transportRegistry) removed() <-chan struct{} {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.removedCh
+}
+
+// contains reports whether t is not removed yet.
+func (r *transportRegistry) contains(t *sessionTransport) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.transports[t.Id()] == t
+}
+
+func (r *transportRegistry) get(id string) (*sessionTransport, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	t, exists := r.transports[id]
+	return t, exists
+}
+
+func (r *transportRegistry) list() []*sessionTransport {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	transports := make([]*sessionTransport, 0, len(r.transports))
+	for _, t := range r.transports {
+		transports = append(transports, t)
+	}
+	return transports
+}
+
+func (r *transportRegistry) count() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.transports)
+}
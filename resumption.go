@@ -0,0 +1,136 @@
+package sylph
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/tkmn0/sylph/internal/transport"
+	"github.com/tkmn0/sylph/pkg/channel"
+)
+
+// session is a Transport of Server which can be resumed with the token.
+// channelConfigs are the channels opened by Server, kept while suspended to be opened again.
+type session struct {
+	token          string
+	transport      *sessionTransport
+	timer          *time.Timer
+	channelConfigs []channel.ChannelConfig
+}
+
+// newResumptionToken creates a random token to resume a Transport.
+func newResumptionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// addSession makes st resumable with the token.
+func (s *Server) addSession(token string, st *sessionTransport, sctp *transport.SctpTransport) *session {
+	ss := &session{token: token, transport: st}
+	sctp.OnTransportLost = func(err error) {
+		s.suspend(ss, sctp)
+	}
+
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	s.sessions[token] = ss
+	return ss
+}
+
+func (s *Server) removeSession(ss *session) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if ss.timer != nil {
+		ss.timer.Stop()
+	}
+	delete(s.sessions, ss.token)
+}
+
+// suspend keeps the lost Transport until ResumptionGracePeriod elapsed.
+func (s *Server) suspend(ss *session, sctp *transport.SctpTransport) {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+	if ss.transport.transport() != sctp {
+		// already resumed by another connection.
+		return
+	}
+	ss.transport.setSuspended(true)
+	ss.channelConfigs = sctp.ChannelConfigs()
+	ss.timer = time.AfterFunc(s.config.ResumptionGracePeriod, func() {
+		s.expire(ss)
+	})
+}
+
+// expire closes the Transport not resumed in ResumptionGracePeriod.
+func (s *Server) expire(ss *session) {
+	s.sessionLock.Lock()
+	if !ss.transport.IsSuspended() {
+		s.sessionLock.Unlock()
+		return
+	}
+	delete(s.sessions, ss.token)
+	s.sessionLock.Unlock()
+
+	ss.transport.notifyClosed()
+}
+
+// expireSessions closes all suspended Transports without waiting for ResumptionGracePeriod.
+func (s *Server) expireSessions() {
+	s.sessionLock.Lock()
+	sessions := []*session{}
+	for _, ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	s.sessionLock.Unlock()
+
+	for _, ss := range sessions {
+		s.expire(ss)
+	}
+}
+
+// resume replaces the underlying SctpTransport of the Transport for the token with sctp,
+// and returns configs of the channels Server opened on the previous one.
+// sctp.ResumptionToken() is the new token of the Transport.
+// The Transport is resumed even if it is not suspended yet,
+// because Client can reconnect before Server detects the timeout.
+func (s *Server) resume(token string, sctp *transport.SctpTransport) ([]channel.ChannelConfig, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	s.sessionLock.Lock()
+	ss, exists := s.sessions[token]
+	if !exists {
+		s.sessionLock.Unlock()
+		return nil, false
+	}
+	if ss.timer != nil {
+		ss.timer.Stop()
+		ss.timer = nil
+	}
+	delete(s.sessions, token)
+	ss.token = sctp.ResumptionToken()
+	s.sessions[ss.token] = ss
+
+	previous := ss.transport.transport()
+	channelConfigs := ss.channelConfigs
+	if !ss.transport.IsSuspended() {
+		channelConfigs = previous.ChannelConfigs()
+	}
+	ss.channelConfigs = nil
+	sctp.SetId(previous.Id())
+	sctp.OnTransportLost = func(err error) {
+		s.suspend(ss, sctp)
+	}
+	ss.transport.attach(sctp)
+	ss.transport.setSuspended(false)
+	s.sessionLock.Unlock()
+
+	if !previous.IsClosed() {
+		previous.Close()
+	}
+	return channelConfigs, true
+}
@@ -1,77 +1,453 @@
 package sylph
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/tkmn0/sylph/internal/engine"
 	"github.com/tkmn0/sylph/internal/listener"
 	"github.com/tkmn0/sylph/internal/transport"
+	"github.com/tkmn0/sylph/pkg/util"
 )
 
 // Server handles base connections. (udp, dtls, sctp)
-// A Server includes a listener.
+// A Server includes listeners, one for each listening address.
 // A Server handles a bundle of Transports.
 // After a Client connected, OnTransport will be called.
 type Server struct {
-	listener           *listener.Listener
-	listenerConfig     listener.ListenerConfig
-	transports         []Transport
-	onTransportHandler func(transport Transport)
-	close              chan bool
+	listeners             []*listener.Listener
+	listenerLock          sync.RWMutex
+	listenerConfig        listener.ListenerConfig
+	config                ServerConfig
+	transports            *transportRegistry
+	onTransportHandler    func(transport Transport)
+	onAuthenticateHandler func(ctx context.Context, payload []byte, remoteAddr net.Addr) error
+	onRejectHandler       func(remoteAddr net.Addr, err error)
+	handshakeLimiter      *rateLimiter
+	connectionLimiter     *rateLimiter
+	pendingHandshakes     int32
+	pendingTransports     int32
+	handshakes            map[*transport.SctpTransport]net.Conn
+	handshakeLock         sync.Mutex
+	shuttingDown          bool
+	sessions              map[string]*session
+	sessionLock           sync.Mutex
+	close                 chan bool
+	done                  chan struct{}
 }
 
 // NewServer creates a Server.
+// The Server generates a self-signed certificate on every Run.
 func NewServer() *Server {
+	return NewServerWithConfig(ServerConfig{})
+}
+
+// NewServerWithConfig creates a Server with ServerConfig.
+func NewServerWithConfig(config ServerConfig) *Server {
 	return &Server{
-		listener:   listener.NewListener(),
-		transports: []Transport{},
+		listeners:         []*listener.Listener{},
+		config:            config,
+		transports:        newTransportRegistry(),
+		handshakeLimiter:  newRateLimiter(config.HandshakeRateLimit),
+		connectionLimiter: newRateLimiter(config.ConnectionRateLimit),
+		sessions:          map[string]*session{},
+		handshakes:        map[*transport.SctpTransport]net.Conn{},
 	}
 }
 
 // obserbeClose obserbes and handles closing
 func (s *Server) obserbeClose() {
 	<-s.close
+	s.listenerLock.Lock()
 	s.close = nil
-	s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.listeners = []*listener.Listener{}
+	close(s.done)
+	s.listenerLock.Unlock()
 }
 
 // Run runs server with address, port, and TransportConfig.
+// Port 0 listens on an ephemeral port, see Addr for the bound address.
+// address can be a name, an IPv4 address or an IPv6 address. A name listens on all of its addresses.
+// Empty address or "::" listens on both IPv4 and IPv6.
 // This will block process, call this with goroutine when necessary.
-func (s *Server) Run(address string, port int, tc TransportConfig) {
-	s.close = make(chan bool)
-	go s.obserbeClose()
+// Run returns an error when the server certificate can not be loaded or listening failed,
+// and returns nil after Close or Shutdown.
+func (s *Server) Run(address string, port int, tc TransportConfig) error {
+	return s.RunWithConfigs([]ListenConfig{{Address: address, Port: port}}, tc)
+}
+
+// RunWithConfigs runs server listening on all addresses of configs as well as Run.
+// Transports of all addresses are passed to the same OnTransport.
+// When listening on any of them failed, the Server is closed and the error is returned.
+func (s *Server) RunWithConfigs(configs []ListenConfig, tc TransportConfig) error {
+	if len(configs) == 0 {
+		return errors.New("no ListenConfig to run")
+	}
+
+	var listeners []*listener.Listener
+	for _, c := range configs {
+		ls, err := s.listen(c, tc)
+		if err != nil {
+			s.Close()
+			return err
+		}
+		listeners = append(listeners, ls...)
+	}
+
+	// each serve returns once, so that none of them blocks after Run returned.
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		l := l
+		go func() {
+			errCh <- s.serve(l, tc)
+		}()
+	}
 
+	s.listenerLock.RLock()
+	done := s.done
+	s.listenerLock.RUnlock()
+	select {
+	case <-done:
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
+
+// Listen starts listening with address, port, and runs server in background.
+// Port 0 listens on an ephemeral port, and Addr returns the bound address after Listen returned.
+// Listen returns an error as well as Run.
+func (s *Server) Listen(address string, port int, tc TransportConfig) error {
+	return s.ListenWithConfig(ListenConfig{Address: address, Port: port}, tc)
+}
+
+// ListenWithConfig starts listening with ListenConfig as well as Listen.
+// This can be called multiple times to listen on multiple addresses.
+func (s *Server) ListenWithConfig(c ListenConfig, tc TransportConfig) error {
+	ls, err := s.listen(c, tc)
+	if err != nil {
+		return err
+	}
+	for _, l := range ls {
+		go s.serve(l, tc)
+	}
+	return nil
+}
+
+// Addr returns the address the Server is listening on. nil is returned before listening.
+// When the Server listens on multiple addresses, the first one is returned.
+func (s *Server) Addr() net.Addr {
+	if addrs := s.Addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return nil
+}
+
+// Addrs returns all addresses the Server is listening on.
+// An address shared by ReusePortWorkers is returned once.
+func (s *Server) Addrs() []net.Addr {
+	s.listenerLock.RLock()
+	defer s.listenerLock.RUnlock()
+	addrs := []net.Addr{}
+	found := map[string]bool{}
+	for _, l := range s.listeners {
+		if addr := l.Addr(); addr != nil && !found[addr.String()] {
+			found[addr.String()] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// workers returns the number of listeners for each address.
+func (s *Server) workers() int {
+	if s.config.ReusePortWorkers > 1 {
+		return s.config.ReusePortWorkers
+	}
+	return 1
+}
+
+// listen creates listeners for each address of ListenConfig.
+// With ReusePortWorkers, listeners of an address are bound to the address of the first one.
+func (s *Server) listen(lc ListenConfig, tc TransportConfig) ([]*listener.Listener, error) {
 	c := listener.ListenerConfig{
-		Address: address,
-		Port:    port,
+		Address:          lc.Address,
+		Port:             lc.Port,
+		Certificate:      s.config.Certificate,
+		KeyPath:          s.config.KeyPath,
+		CertificatePath:  s.config.CertificatePath,
+		ClientAuth:       s.config.ClientAuth,
+		ClientCAs:        s.config.ClientCAs,
+		PSK:              s.config.PSK,
+		PSKIdentityHint:  s.config.PSKIdentityHint,
+		PacketConn:       lc.PacketConn,
+		Fallback:         lc.Fallback,
+		Admit:            s.admitHandshake,
+		HandshakeTimeout: tc.handshakeTimeout(),
+	}
+	if lc.Certificate != nil || lc.KeyPath != "" || lc.CertificatePath != "" {
+		c.Certificate = lc.Certificate
+		c.KeyPath = lc.KeyPath
+		c.CertificatePath = lc.CertificatePath
+	}
+
+	workers := 1
+	if lc.PacketConn == nil && s.workers() > 1 {
+		workers = s.workers()
+		c.ReusePort = true
 	}
-	s.listener.Listen(c)
+
+	addresses, err := s.listenAddresses(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := []*listener.Listener{}
+	for _, address := range addresses {
+		c.Address = address
+		for i := 0; i < workers; i++ {
+			l := listener.NewListener()
+			if err := l.Listen(c); err != nil {
+				for _, l := range ls {
+					l.Close()
+				}
+				return nil, err
+			}
+			ls = append(ls, l)
+
+			// workers are bound to the address of the first one,
+			// and other addresses are bound to the same port.
+			if addr, ok := l.Addr().(*net.UDPAddr); ok && i == 0 {
+				c.Address = udpAddrHost(addr)
+				c.Port = addr.Port
+			}
+		}
+	}
+
+	s.listenerLock.Lock()
+	defer s.listenerLock.Unlock()
+	s.listeners = append(s.listeners, ls...)
+	if s.close == nil {
+		s.close = make(chan bool, 1)
+		s.done = make(chan struct{})
+		go s.obserbeClose()
+	}
+	return ls, nil
+}
+
+// listenAddresses resolves the address of ListenConfig, all of the resolved addresses are listened on.
+func (s *Server) listenAddresses(lc ListenConfig) ([]string, error) {
+	if lc.PacketConn != nil {
+		return []string{lc.Address}, nil
+	}
+	addrs, err := util.ResolveUDPAddrs(context.Background(), lc.Address, lc.Port)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		addresses = append(addresses, udpAddrHost(addr))
+	}
+	return addresses, nil
+}
+
+// udpAddrHost returns the host of addr with the zone, empty for the unspecified address.
+func udpAddrHost(addr *net.UDPAddr) string {
+	if addr.IP == nil {
+		return ""
+	}
+	if addr.Zone != "" {
+		return addr.IP.String() + "%" + addr.Zone
+	}
+	return addr.IP.String()
+}
+
+// serve creates Transports for connections accepted by the listener, until the Server closed.
+func (s *Server) serve(l *listener.Listener, tc TransportConfig) error {
+	s.listenerLock.RLock()
+	done := s.done
+	s.listenerLock.RUnlock()
+
 	for {
-		conn := <-s.listener.Connection
+		var conn net.Conn
+		select {
+		case conn = <-l.Connection:
+		case <-done:
+			return nil
+		}
+		if err := s.admitConnection(conn.RemoteAddr()); err != nil {
+			conn.Close()
+			continue
+		}
+
 		id, err := s.createId()
 		if err != nil {
 			fmt.Println("id creation error")
-			return
+			s.releaseTransport()
+			conn.Close()
+			return err
 		}
 
-		sctp := transport.NewSctpTransport(id)
-		err = sctp.Init(conn, false, engine.EngineConfig{
-			HeartbeatRateMillisec:   tc.HeartbeatRateMillisec,
-			TimeOutDurationMilliSec: tc.TimeOutDurationMilliSec,
-		})
+		go s.startTransport(conn, id, tc)
+	}
+}
 
+// startTransport creates the Transport of the connection, and accepts its streams until it closed.
+// The Transport is closed when Client does not finish the transport handshake within HandshakeTimeout,
+// so that a silent Client does not keep its reservation.
+func (s *Server) startTransport(conn net.Conn, id string, tc TransportConfig) {
+	// the reservation is released when the Transport is registered, or closed before that.
+	var releaseOnce sync.Once
+	release := func() {
+		releaseOnce.Do(s.releaseTransport)
+	}
+	sctp := transport.NewSctpTransport(id)
+	if !s.addHandshake(sctp, conn) {
+		release()
+		conn.Close()
+		return
+	}
+	sctp.DCEP = tc.DCEP
+	sctp.OnAuthenticate = func(ctx context.Context, payload []byte) error {
+		if s.onAuthenticateHandler == nil {
+			return nil
+		}
+		return s.onAuthenticateHandler(ctx, payload, conn.RemoteAddr())
+	}
+	deadline := time.AfterFunc(tc.handshakeTimeout(), func() {
+		sctp.Close()
+		conn.Close()
+	})
+	var established func()
+	sctp.OnTransportInitialized = func() {
+		deadline.Stop()
+		established = s.finishHandshake(sctp)
+		release()
+	}
+	sctp.OnTransportEstablished = func() {
+		if established != nil {
+			established()
+		}
+	}
+	sctp.OnClose(func() {
+		s.removeHandshake(sctp)
+		release()
+	})
+	err := sctp.Init(conn, false, engine.EngineConfig{
+		HeartbeatRateMillisec:   tc.HeartbeatRateMillisec,
+		TimeOutDurationMilliSec: tc.TimeOutDurationMilliSec,
+		MaxMessageSize:          tc.MaxMessageSize,
+	})
+	if err != nil {
+		fmt.Println("sctp initialize error")
+		deadline.Stop()
+		s.removeHandshake(sctp)
+		release()
+		conn.Close()
+		return
+	}
+
+	sctp.AcceptStreamLoop()
+}
+
+// addHandshake tracks the Transport until the transport handshake finished, so that Shutdown closes it.
+// false is returned after Shutdown started.
+func (s *Server) addHandshake(sctp *transport.SctpTransport, conn net.Conn) bool {
+	s.handshakeLock.Lock()
+	defer s.handshakeLock.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.handshakes[sctp] = conn
+	return true
+}
+
+// finishHandshake registers the Transport, and returns the function called after the reply to Client.
+// nil is returned after Shutdown started, the Transport is closed by Shutdown then.
+func (s *Server) finishHandshake(sctp *transport.SctpTransport) func() {
+	s.handshakeLock.Lock()
+	defer s.handshakeLock.Unlock()
+	if s.shuttingDown {
+		return nil
+	}
+	delete(s.handshakes, sctp)
+	return s.onTransportInitialized(sctp)
+}
+
+func (s *Server) removeHandshake(sctp *transport.SctpTransport) {
+	s.handshakeLock.Lock()
+	defer s.handshakeLock.Unlock()
+	delete(s.handshakes, sctp)
+}
+
+// closeHandshakes stops accepting the transport handshake, and closes Transports in the handshake.
+func (s *Server) closeHandshakes() {
+	s.handshakeLock.Lock()
+	s.shuttingDown = true
+	handshakes := s.handshakes
+	s.handshakes = map[*transport.SctpTransport]net.Conn{}
+	s.handshakeLock.Unlock()
+
+	for sctp, conn := range handshakes {
+		sctp.Close()
+		conn.Close()
+	}
+}
+
+// RunAddr runs server with addr ("host:port") as well as Run.
+// IPv6 address is written as "[::1]:port".
+func (s *Server) RunAddr(addr string, tc TransportConfig) error {
+	host, port, err := util.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	return s.Run(host, port, tc)
+}
+
+// onTransportInitialized resumes a suspended Transport with the resumption token sent by Client,
+// or registers a new Transport, and returns the function called after the reply to Client.
+// The function opens the channels of the resumed Transport again, or passes the new Transport to OnTransport.
+func (s *Server) onTransportInitialized(sctp *transport.SctpTransport) func() {
+	token := sctp.ResumptionToken()
+	sctp.SetResumptionToken("")
+
+	st := newSessionTransport()
+	var ss *session
+	if s.config.ResumptionGracePeriod > 0 {
+		newToken, err := newResumptionToken()
 		if err != nil {
-			fmt.Println("sctp initialize error")
+			fmt.Println("resumption token creation error", err)
+		} else {
+			sctp.SetResumptionToken(newToken)
+			if channelConfigs, resumed := s.resume(token, sctp); resumed {
+				return func() {
+					sctp.ReopenChannels(channelConfigs)
+				}
+			}
+			ss = s.addSession(newToken, st, sctp)
 		}
+	}
+	st.onReleased = func() {
+		s.transports.remove(st)
+		if ss != nil {
+			s.removeSession(ss)
+		}
+	}
 
-		s.transports = append(s.transports, sctp)
+	st.attach(sctp)
+	s.transports.add(st)
+	return func() {
 		if s.onTransportHandler != nil {
-			s.onTransportHandler(sctp)
+			s.onTransportHandler(st)
 		}
-
-		go sctp.AcceptStreamLoop()
-
 	}
 }
 
@@ -85,22 +461,153 @@ func (s *Server) createId() (string, error) {
 	}
 	uuid := uuidObj.String()
 
-	for _, sctp := range s.transports {
-		if sctp.Id() == uuid {
-			return s.createId()
-		}
+	if _, exists := s.transports.get(uuid); exists {
+		return s.createId()
 	}
 	return uuid, nil
 }
 
+// Transport returns the Transport corresponded with id. nil is returned when not found.
+// Suspended Transports are also returned.
+func (s *Server) Transport(id string) Transport {
+	if t, exists := s.transports.get(id); exists {
+		return t
+	}
+	return nil
+}
+
+// Transports returns the Transports connected with the Server.
+func (s *Server) Transports() []Transport {
+	transports := []Transport{}
+	for _, t := range s.transports.list() {
+		transports = append(transports, t)
+	}
+	return transports
+}
+
+// TransportCount returns the number of the Transports connected with the Server.
+func (s *Server) TransportCount() int {
+	return s.transports.count()
+}
+
 // OnTransport will be called when Client connected.
+// When OnAuthenticate is set, this is called after the Client is authenticated.
 func (s *Server) OnTransport(handler func(t Transport)) {
 	s.onTransportHandler = handler
 }
 
+// OnAuthenticate will be called with the auth payload sent by Client, before OnTransport.
+// Returning an error rejects the transport, and the error message is sent to the Client as the reason.
+// ctx is canceled when the transport is closed, or HandshakeTimeout of TransportConfig elapsed.
+func (s *Server) OnAuthenticate(handler func(ctx context.Context, payload []byte, remoteAddr net.Addr) error) {
+	s.onAuthenticateHandler = handler
+}
+
+// OnReject will be called when a connection is refused by ServerConfig, with the remote address and
+// the reason, ErrTooManyTransports, ErrTooManyHandshakes, ErrHandshakeRateLimited or ErrConnectionRateLimited.
+func (s *Server) OnReject(handler func(remoteAddr net.Addr, err error)) {
+	s.onRejectHandler = handler
+}
+
 // Close closes server.
+// Transports are not closed, use Shutdown to close them.
 func (s *Server) Close() {
-	if s.close != nil {
-		s.close <- true
+	s.listenerLock.RLock()
+	closeCh := s.close
+	s.listenerLock.RUnlock()
+	if closeCh != nil {
+		select {
+		case closeCh <- true:
+		default:
+			// already closing
+		}
+	}
+}
+
+// Shutdown closes server gracefully.
+// Shutdown stops listening, closes connections in the handshake, waits for data on channels to be delivered,
+// and notifies Clients that the Server is going away. Clients close their Transports with the notification.
+// After the notification is delivered, the remaining Transports are closed by the Server,
+// and Shutdown returns nil when all Transports are closed.
+// When ctx is done before that, the remaining Transports are closed forcibly and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.Close()
+	s.expireSessions()
+	s.closeHandshakes()
+
+	transports := s.transports.list()
+
+	err := s.waitDrained(ctx, transports)
+	if err == nil {
+		for _, t := range transports {
+			if !t.IsClosed() {
+				t.goAway()
+			}
+		}
+		err = s.waitDrained(ctx, transports)
+	}
+
+	// Clients of version 0 ignore the notification.
+	for _, t := range transports {
+		if !t.IsClosed() {
+			t.Close()
+		}
+	}
+	if err == nil {
+		err = s.waitRemoved(ctx, transports)
+	}
+	return err
+}
+
+// drainPollInterval is interval to check buffered data of Transports in Shutdown.
+// sctp notifies no event when all data is acknowledged, closed Transports are notified by the registry.
+const drainPollInterval = time.Millisecond * 10
+
+// waitDrained waits until data of all transports is delivered or they are closed, or ctx is done.
+func (s *Server) waitDrained(ctx context.Context, transports []*sessionTransport) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		removed := s.transports.removed()
+		drained := true
+		for _, t := range transports {
+			if s.transports.contains(t) && t.bufferedAmount() != 0 {
+				drained = false
+				break
+			}
+		}
+		if drained {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-removed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitRemoved waits until all transports are closed and removed from the registry, or ctx is done.
+func (s *Server) waitRemoved(ctx context.Context, transports []*sessionTransport) error {
+	for {
+		removed := s.transports.removed()
+		finished := true
+		for _, t := range transports {
+			if s.transports.contains(t) {
+				finished = false
+				break
+			}
+		}
+		if finished {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-removed:
+		}
 	}
 }
@@ -1,21 +1,42 @@
 package sylph_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/pion/dtls/v2"
+	"github.com/pion/dtls/v2/pkg/crypto/selfsign"
+	"github.com/pion/logging"
+	"github.com/pion/sctp"
 	"github.com/tkmn0/sylph"
+	"github.com/tkmn0/sylph/internal/engine"
+	"github.com/tkmn0/sylph/internal/transport"
 	"github.com/tkmn0/sylph/pkg/channel"
 )
 
+var testTransportConfig = sylph.TransportConfig{
+	HeartbeatRateMillisec:   1000,
+	TimeOutDurationMilliSec: 300,
+}
+
 func TestServerConnection(test *testing.T) {
 	fmt.Println("TestServerConnection")
 	closeCh := make(chan bool)
 
-	s := sylph.NewServer("127.0.0.1", 4444)
+	s := sylph.NewServer()
 	defer s.Close()
-	s.OnTransport = func(t sylph.Transport) {
+	s.OnTransport(func(t sylph.Transport) {
 		fmt.Println("server on transport")
 		t.OnChannel(func(c channel.Channel) {
 			fmt.Println("server on channel")
@@ -23,13 +44,13 @@ func TestServerConnection(test *testing.T) {
 				fmt.Println("server on message", m)
 			})
 		})
-	}
-	go s.Run()
+	})
+	go s.Run("127.0.0.1", 4444, testTransportConfig)
 
 	c := sylph.NewClient()
-	c.OnTransport = func(t sylph.Transport) {
+	c.OnTransport(func(t sylph.Transport) {
 		fmt.Println("client on transport")
-		t.OnChannel(func(c channel.Channel) {
+		handleChannel := func(c channel.Channel) {
 			fmt.Println("client on channel")
 			counter := 0
 		loop:
@@ -42,10 +63,17 @@ func TestServerConnection(test *testing.T) {
 					break loop
 				}
 			}
-		})
-		t.OpenChannel()
-	}
-	c.Connect("127.0.0.1", 4444)
+		}
+		go func() {
+			ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+			if err != nil {
+				test.Error(err)
+				return
+			}
+			handleChannel(ch)
+		}()
+	})
+	c.Connect("127.0.0.1", 4444, testTransportConfig)
 
 	{
 		<-closeCh
@@ -57,8 +85,8 @@ func TestServerConnection(test *testing.T) {
 
 func TestChannelClose(test *testing.T) {
 	fmt.Println("TestChannelClose")
-	s := sylph.NewServer("127.0.0.1", 4444)
-	s.OnTransport = func(t sylph.Transport) {
+	s := sylph.NewServer()
+	s.OnTransport(func(t sylph.Transport) {
 		fmt.Println("server on transport")
 		t.OnChannel(func(c channel.Channel) {
 			fmt.Println("server on channel")
@@ -66,13 +94,13 @@ func TestChannelClose(test *testing.T) {
 				fmt.Println("server on message", m)
 			})
 		})
-	}
-	go s.Run()
+	})
+	go s.Run("127.0.0.1", 4444, testTransportConfig)
 
 	c := sylph.NewClient()
-	c.OnTransport = func(t sylph.Transport) {
+	c.OnTransport(func(t sylph.Transport) {
 		fmt.Println("client on transport")
-		t.OnChannel(func(c channel.Channel) {
+		handleChannel := func(c channel.Channel) {
 			fmt.Println("client on channel")
 			counter := 0
 		loop:
@@ -85,15 +113,2062 @@ func TestChannelClose(test *testing.T) {
 					break loop
 				}
 			}
+		}
+		go func() {
+			for i := 0; i < 2; i++ {
+				ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+				if err != nil {
+					fmt.Println("open channel erorr", err)
+					continue
+				}
+				handleChannel(ch)
+			}
+		}()
+	})
+	c.Connect("127.0.0.1", 4444, testTransportConfig)
+
+}
+
+func TestCertificateFingerprintMismatch(test *testing.T) {
+	fmt.Println("TestCertificateFingerprintMismatch")
+	s := sylph.NewServer()
+	defer s.Close()
+	go s.Run("127.0.0.1", 4445, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	c := sylph.NewClient()
+	c.OnTransport(func(t sylph.Transport) {
+		test.Error("transport should not be established")
+	})
+	tc := testTransportConfig
+	tc.CertificateFingerprint = make([]byte, 32)
+	c.Connect("127.0.0.1", 4445, tc)
+
+	if c.ConnectionState() != sylph.AuthFailed {
+		test.Errorf("connection state should be AuthFailed, got %s", c.ConnectionState())
+	}
+}
+
+func TestServerCertificate(test *testing.T) {
+	fmt.Println("TestServerCertificate")
+	certificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{Certificate: &certificate})
+	defer s.Close()
+	go s.Run("127.0.0.1", 4446, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	c := sylph.NewClient()
+	defer c.Close()
+	tc := testTransportConfig
+	tc.CertificateFingerprint = sylph.Fingerprint(certificate)
+	c.Connect("127.0.0.1", 4446, tc)
+
+	if c.ConnectionState() != sylph.Connected {
+		test.Errorf("connection state should be Connected, got %s", c.ConnectionState())
+	}
+}
+
+func TestServerCertificateLoadError(test *testing.T) {
+	fmt.Println("TestServerCertificateLoadError")
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{
+		KeyPath:         "not_exist_key.pem",
+		CertificatePath: "not_exist_cert.pem",
+	})
+
+	if err := s.Run("127.0.0.1", 4447, testTransportConfig); err == nil {
+		test.Error("Run should return an error when certificate can not be loaded")
+	}
+}
+
+func TestClientCertificate(test *testing.T) {
+	fmt.Println("TestClientCertificate")
+	clientCertificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		test.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(clientCertificate.Certificate[0])
+	if err != nil {
+		test.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(leaf)
+
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	})
+	defer s.Close()
+	onTransport := make(chan sylph.Transport, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		onTransport <- t
+	})
+	go s.Run("127.0.0.1", 4448, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	rejected := sylph.NewClient()
+	defer rejected.Close()
+	rejected.Connect("127.0.0.1", 4448, testTransportConfig)
+	if rejected.ConnectionState() == sylph.Connected {
+		test.Error("client without a trusted certificate should not connect")
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	tc := testTransportConfig
+	tc.Certificate = &clientCertificate
+	c.Connect("127.0.0.1", 4448, tc)
+
+	select {
+	case t := <-onTransport:
+		certificates, err := t.PeerCertificates()
+		if err != nil {
+			test.Error("peer certificates should be parsed", err)
+		}
+		if len(certificates) == 0 || !bytes.Equal(certificates[0].Raw, leaf.Raw) {
+			test.Error("peer certificate should be the client certificate")
+		}
+		if t.RemoteAddr() == nil {
+			test.Error("remote address should be exposed")
+		}
+	case <-time.After(time.Second * 3):
+		test.Error("transport should be established")
+	}
+}
+
+func TestPreSharedKey(test *testing.T) {
+	fmt.Println("TestPreSharedKey")
+	keys := map[string][]byte{
+		"client": {0xAB, 0xC1, 0x23},
+	}
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{
+		PSK: func(identity []byte) ([]byte, error) {
+			if key, exists := keys[string(identity)]; exists {
+				return key, nil
+			}
+			return nil, fmt.Errorf("unknown identity %s", identity)
+		},
+		PSKIdentityHint: []byte("sylph"),
+	})
+	defer s.Close()
+	onTransport := make(chan sylph.Transport, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		onTransport <- t
+	})
+	go s.Run("127.0.0.1", 4449, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	c := sylph.NewClient()
+	defer c.Close()
+	tc := testTransportConfig
+	tc.PSK = keys["client"]
+	tc.PSKIdentityHint = []byte("client")
+	c.Connect("127.0.0.1", 4449, tc)
+
+	select {
+	case <-onTransport:
+	case <-time.After(time.Second * 3):
+		test.Error("transport should be established")
+	}
+
+	rejected := sylph.NewClient()
+	defer rejected.Close()
+	tc.PSK = []byte{0x00}
+	rejected.Connect("127.0.0.1", 4449, tc)
+	if rejected.ConnectionState() == sylph.Connected {
+		test.Error("client with a wrong key should not connect")
+	}
+}
+
+func TestAuthenticate(test *testing.T) {
+	fmt.Println("TestAuthenticate")
+	s := sylph.NewServer()
+	defer s.Close()
+	largeToken := bytes.Repeat([]byte("t"), 65535)
+	s.OnAuthenticate(func(ctx context.Context, payload []byte, remoteAddr net.Addr) error {
+		if string(payload) != "secret" && !bytes.Equal(payload, largeToken) {
+			return errors.New("invalid token")
+		}
+		return nil
+	})
+	onTransport := make(chan sylph.Transport, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		onTransport <- t
+	})
+	go s.Run("127.0.0.1", 4450, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	rejected := sylph.NewClient()
+	stateCh := make(chan sylph.ConnectionState, 2)
+	rejected.OnConnectionStateChanged(func(state sylph.ConnectionState) {
+		stateCh <- state
+	})
+	tc := testTransportConfig
+	tc.AuthPayload = []byte("wrong")
+	rejected.Connect("127.0.0.1", 4450, tc)
+
+	timeout := time.After(time.Second * 3)
+loop:
+	for {
+		select {
+		case state := <-stateCh:
+			if state == sylph.Rejected {
+				var rejectedError *sylph.RejectedError
+				if !errors.As(rejected.Err(), &rejectedError) || rejectedError.Reason != "invalid token" {
+					test.Errorf("rejection reason should be delivered, got %v", rejected.Err())
+				}
+				break loop
+			}
+		case <-onTransport:
+			test.Fatal("rejected transport should not be notified")
+		case <-timeout:
+			test.Fatal("transport should be rejected")
+		}
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	clientTransport := make(chan sylph.Transport, 1)
+	c.OnTransport(func(t sylph.Transport) {
+		clientTransport <- t
+	})
+	tc.AuthPayload = []byte("secret")
+	c.Connect("127.0.0.1", 4450, tc)
+
+	select {
+	case <-onTransport:
+	case <-time.After(time.Second * 3):
+		test.Fatal("transport should be established")
+	}
+	select {
+	case <-clientTransport:
+	case <-time.After(time.Second * 3):
+		test.Fatal("client transport should be established")
+	}
+
+	// the initialize message larger than a frame is sent in chunks.
+	large := sylph.NewClient()
+	defer large.Close()
+	tc.AuthPayload = largeToken
+	if _, err := large.ConnectContext(context.Background(), "127.0.0.1:4450", tc); err != nil {
+		test.Fatalf("large auth payload should be accepted, got %v", err)
+	}
+
+	tooLarge := sylph.NewClient()
+	defer tooLarge.Close()
+	tc.AuthPayload = append(largeToken, 't')
+	var associationError *sylph.AssociationError
+	if _, err := tooLarge.ConnectContext(context.Background(), "127.0.0.1:4450", tc); !errors.As(err, &associationError) || !errors.Is(err, sylph.ErrFieldTooLarge) {
+		test.Errorf("auth payload over 65535 bytes should return ErrFieldTooLarge, got %v", err)
+	}
+}
+
+// udpProxy relays udp packets between clients and a server.
+// While blocked, all packets are dropped to simulate network drops.
+type udpProxy struct {
+	conn    *net.UDPConn
+	server  *net.UDPAddr
+	lock    sync.Mutex
+	blocked bool
+}
+
+func newUDPProxy(test *testing.T, serverPort int) *udpProxy {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		test.Fatal(err)
+	}
+	p := &udpProxy{
+		conn:   conn,
+		server: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: serverPort},
+	}
+	go p.run()
+	return p
+}
+
+func (p *udpProxy) port() int {
+	return p.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func (p *udpProxy) setBlocked(blocked bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.blocked = blocked
+}
+
+func (p *udpProxy) isBlocked() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.blocked
+}
+
+func (p *udpProxy) run() {
+	upstreams := map[string]*net.UDPConn{}
+	buffer := make([]byte, 8192)
+	for {
+		n, client, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		upstream, exists := upstreams[client.String()]
+		if !exists {
+			upstream, err = net.DialUDP("udp", nil, p.server)
+			if err != nil {
+				continue
+			}
+			upstreams[client.String()] = upstream
+			go func(upstream *net.UDPConn, client *net.UDPAddr) {
+				buffer := make([]byte, 8192)
+				for {
+					n, err := upstream.Read(buffer)
+					if err != nil {
+						return
+					}
+					if !p.isBlocked() {
+						p.conn.WriteToUDP(buffer[:n], client)
+					}
+				}
+			}(upstream, client)
+		}
+		if !p.isBlocked() {
+			upstream.Write(buffer[:n])
+		}
+	}
+}
+
+func (p *udpProxy) close() {
+	p.conn.Close()
+}
+
+func TestReconnect(test *testing.T) {
+	fmt.Println("TestReconnect")
+	s := sylph.NewServer()
+	defer s.Close()
+	serverChannels := make(chan channel.Channel, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			serverChannels <- c
+		})
+	})
+	go s.Run("127.0.0.1", 4451, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	proxy := newUDPProxy(test, 4451)
+	defer proxy.close()
+
+	c := sylph.NewClient()
+	defer c.Close()
+	states := make(chan sylph.ConnectionState, 8)
+	c.OnConnectionStateChanged(func(state sylph.ConnectionState) {
+		states <- state
+	})
+	transportClosed := make(chan bool, 1)
+	c.OnTransport(func(t sylph.Transport) {
+		t.OnClose(func() {
+			transportClosed <- true
+		})
+		go t.OpenChannel(context.Background(), channel.ChannelConfig{})
+	})
+	tc := testTransportConfig
+	tc.Reconnect = &sylph.ReconnectPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: time.Millisecond * 100,
+		MaxBackoff:     time.Second,
+		Jitter:         0.1,
+	}
+	c.Connect("127.0.0.1", proxy.port(), tc)
+
+	select {
+	case <-serverChannels:
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be opened")
+	}
+
+	// wait for heartbeat to start health check.
+	time.Sleep(time.Millisecond * 1500)
+	proxy.setBlocked(true)
+	waitState := func(expected sylph.ConnectionState) {
+		timeout := time.After(time.Second * 5)
+		for {
+			select {
+			case state := <-states:
+				if state == expected {
+					return
+				}
+			case <-timeout:
+				test.Fatalf("connection state should be %s", expected)
+			}
+		}
+	}
+	waitState(sylph.Reconnecting)
+	proxy.setBlocked(false)
+	waitState(sylph.Reconnected)
+
+	select {
+	case <-serverChannels:
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be reopened")
+	}
+
+	select {
+	case <-transportClosed:
+		test.Error("transport should not be closed while reconnected")
+	default:
+	}
+}
+
+// failingPacketConn fails reading once when fail is called.
+type failingPacketConn struct {
+	net.PacketConn
+	lock    sync.Mutex
+	failing bool
+}
+
+func (c *failingPacketConn) fail() {
+	c.lock.Lock()
+	c.failing = true
+	c.lock.Unlock()
+	c.PacketConn.SetReadDeadline(time.Now())
+}
+
+func (c *failingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.failing {
+		c.failing = false
+		return 0, nil, errors.New("connection failed")
+	}
+	return n, addr, err
+}
+
+func TestReconnectAfterConnectionFailure(test *testing.T) {
+	fmt.Println("TestReconnectAfterConnectionFailure")
+	// heartbeat does not time out during the test, the failure of the connection triggers reconnection.
+	tc := sylph.TransportConfig{
+		HeartbeatRateMillisec:   5000,
+		TimeOutDurationMilliSec: 5000,
+		Reconnect: &sylph.ReconnectPolicy{
+			MaxAttempts:    5,
+			InitialBackoff: time.Millisecond * 100,
+		},
+	}
+	s := sylph.NewServer()
+	defer s.Close()
+	serverChannels := make(chan channel.Channel, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			serverChannels <- c
+		})
+	})
+	go s.Run("127.0.0.1", 4479, tc)
+	time.Sleep(time.Millisecond * 100)
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer udpConn.Close()
+	conn := &failingPacketConn{PacketConn: udpConn}
+
+	c := sylph.NewClientWithPacketConn(conn)
+	defer c.Close()
+	reconnected := make(chan bool, 1)
+	c.OnConnectionStateChanged(func(state sylph.ConnectionState) {
+		if state == sylph.Reconnected {
+			reconnected <- true
+		}
+	})
+	t, err := c.ConnectContext(context.Background(), "127.0.0.1:4479", tc)
+	if err != nil {
+		test.Fatal(err)
+	}
+	ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{Label: "kept"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	channelClosed := make(chan bool, 1)
+	ch.OnClose(func() {
+		channelClosed <- true
+	})
+	<-serverChannels
+
+	conn.fail()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 3):
+		test.Fatal("client should reconnect after the connection failed")
+	}
+	select {
+	case <-channelClosed:
+	case <-time.After(time.Second):
+		test.Error("OnClose of the channel should be called when the transport is lost")
+	}
+	select {
+	case c := <-serverChannels:
+		if c.Label() != "kept" {
+			test.Errorf("reopened channel label should be kept, got %s", c.Label())
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be reopened")
+	}
+	if t.IsClosed() {
+		test.Error("transport should not be closed while reconnected")
+	}
+}
+
+func TestResumption(test *testing.T) {
+	fmt.Println("TestResumption")
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{
+		ResumptionGracePeriod: time.Second * 10,
+	})
+	defer s.Close()
+	serverTransports := make(chan sylph.Transport, 2)
+	serverChannels := make(chan channel.Channel, 3)
+	serverClosed := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			serverChannels <- c
+		})
+		t.OnClose(func() {
+			serverClosed <- true
+		})
+		go t.OpenChannel(context.Background(), channel.ChannelConfig{Label: "from server"})
+		serverTransports <- t
+	})
+	go s.Run("127.0.0.1", 4452, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	proxy := newUDPProxy(test, 4452)
+	defer proxy.close()
+
+	c := sylph.NewClient()
+	defer c.Close()
+	reconnected := make(chan bool, 1)
+	c.OnConnectionStateChanged(func(state sylph.ConnectionState) {
+		if state == sylph.Reconnected {
+			reconnected <- true
+		}
+	})
+	clientTransports := make(chan sylph.Transport, 1)
+	clientChannels := make(chan channel.Channel, 3)
+	c.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			clientChannels <- c
+		})
+		go t.OpenChannel(context.Background(), channel.ChannelConfig{})
+		clientTransports <- t
+	})
+	tc := testTransportConfig
+	tc.Reconnect = &sylph.ReconnectPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: time.Millisecond * 100,
+		MaxBackoff:     time.Second,
+	}
+	c.Connect("127.0.0.1", proxy.port(), tc)
+
+	var serverTransport sylph.Transport
+	select {
+	case serverTransport = <-serverTransports:
+	case <-time.After(time.Second * 3):
+		test.Fatal("server transport should be created")
+	}
+	clientTransport := <-clientTransports
+	id := clientTransport.Id()
+	<-serverChannels
+	<-clientChannels
+
+	// wait for heartbeat to start health check.
+	time.Sleep(time.Millisecond * 1500)
+	proxy.setBlocked(true)
+	for i := 0; !serverTransport.IsSuspended(); i++ {
+		if i > 50 {
+			test.Fatal("server transport should be suspended")
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	proxy.setBlocked(false)
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 10):
+		test.Fatal("client should reconnect")
+	}
+	// channels reopened by each side are also passed to OnChannel of it.
+	for reopened := false; !reopened; {
+		select {
+		case c := <-serverChannels:
+			reopened = c.Label() == ""
+		case <-time.After(time.Second * 3):
+			test.Fatal("channel should be reopened on the resumed transport")
+		}
+	}
+	for reopened := false; !reopened; {
+		select {
+		case c := <-clientChannels:
+			reopened = c.Label() == "from server"
+		case <-time.After(time.Second * 3):
+			test.Fatal("server channel should be reopened on the resumed transport")
+		}
+	}
+
+	if clientTransport.Id() != id {
+		test.Errorf("transport id should be kept, expected %s, got %s", id, clientTransport.Id())
+	}
+	if serverTransport.IsSuspended() || serverTransport.IsClosed() {
+		test.Error("server transport should be resumed")
+	}
+	select {
+	case <-serverTransports:
+		test.Error("OnTransport should not be called for the resumed transport")
+	case <-serverClosed:
+		test.Error("server transport should not be closed while suspended")
+	default:
+	}
+}
+
+func TestConnectContext(test *testing.T) {
+	fmt.Println("TestConnectContext")
+	s := sylph.NewServer()
+	defer s.Close()
+	go s.Run("127.0.0.1", 4453, testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	c := sylph.NewClient()
+	t, err := c.ConnectContext(context.Background(), "127.0.0.1:4453", testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if t == nil || t.Id() == "" {
+		test.Error("transport should be returned")
+	}
+	c.Close()
+
+	// nothing is listening
+	c = sylph.NewClient()
+	_, err = c.ConnectContext(context.Background(), "127.0.0.1:4454", testTransportConfig)
+	if !errors.Is(err, sylph.ErrConnectionRefused) {
+		test.Errorf("error should be ErrConnectionRefused, got %v", err)
+	}
+
+	// listening, but never replies
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	tc := testTransportConfig
+	tc.HandshakeTimeout = time.Millisecond * 300
+	start := time.Now()
+	c = sylph.NewClient()
+	_, err = c.ConnectContext(context.Background(), conn.LocalAddr().String(), tc)
+	if !errors.Is(err, sylph.ErrHandshakeTimeout) {
+		test.Errorf("error should be ErrHandshakeTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		test.Errorf("handshake timeout should be applied, took %v", elapsed)
+	}
+	if c.ConnectionState() != sylph.TimeOut {
+		test.Errorf("connection state should be TimeOut, got %s", c.ConnectionState())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*100, cancel)
+	c = sylph.NewClient()
+	_, err = c.ConnectContext(ctx, conn.LocalAddr().String(), testTransportConfig)
+	if !errors.Is(err, context.Canceled) {
+		test.Errorf("error should be context.Canceled, got %v", err)
+	}
+}
+
+func TestHostnameAndIPv6(test *testing.T) {
+	fmt.Println("TestHostnameAndIPv6")
+	if conn, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		test.Skip("IPv6 is not available")
+	} else {
+		conn.Close()
+	}
+
+	s := sylph.NewServer()
+	defer s.Close()
+	go s.RunAddr("[::]:4455", testTransportConfig)
+	time.Sleep(time.Millisecond * 100)
+
+	for _, addr := range []string{"localhost:4455", "127.0.0.1:4455", "[::1]:4455"} {
+		c := sylph.NewClient()
+		t, err := c.ConnectContext(context.Background(), addr, testTransportConfig)
+		if err != nil {
+			test.Errorf("%s: %v", addr, err)
+			continue
+		}
+		if t.RemoteAddr() == nil {
+			test.Errorf("%s: remote address should be set", addr)
+		}
+		c.Close()
+	}
+
+	// a name listens on all of its addresses.
+	ips, err := net.LookupIP("localhost")
+	if err != nil {
+		test.Fatal(err)
+	}
+	s2 := sylph.NewServer()
+	defer s2.Close()
+	if err := s2.Listen("localhost", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	if addrs := s2.Addrs(); len(addrs) != len(ips) {
+		test.Errorf("server should listen on %d addresses of localhost, got %v", len(ips), addrs)
+	}
+	for _, addr := range s2.Addrs() {
+		c := sylph.NewClient()
+		if _, err := c.ConnectContext(context.Background(), addr.String(), testTransportConfig); err != nil {
+			test.Errorf("%s: %v", addr, err)
+		}
+		c.Close()
+	}
+}
+
+func TestEphemeralPort(test *testing.T) {
+	fmt.Println("TestEphemeralPort")
+	addrs := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		s := sylph.NewServer()
+		defer s.Close()
+		if s.Addr() != nil {
+			test.Error("address should be nil before listening")
+		}
+		if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+			test.Fatal(err)
+		}
+		addr := s.Addr().(*net.UDPAddr)
+		if addr.Port == 0 || addrs[addr.String()] {
+			test.Fatalf("ephemeral port should be bound, got %s", addr)
+		}
+		addrs[addr.String()] = true
+
+		c := sylph.NewClient()
+		if _, err := c.ConnectContext(context.Background(), addr.String(), testTransportConfig); err != nil {
+			test.Error(err)
+		}
+		c.Close()
+	}
+}
+
+func TestShutdown(test *testing.T) {
+	fmt.Println("TestShutdown")
+	s := sylph.NewServer()
+	serverClosed := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnClose(func() {
+			serverClosed <- true
 		})
-		if err := t.OpenChannel(); err != nil {
-			fmt.Println("open first channel erorr")
+		t.OnChannel(func(c channel.Channel) {
+			c.SendMessage("bye")
+		})
+	})
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run("127.0.0.1", 4456, testTransportConfig)
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	c := sylph.NewClient()
+	defer c.Close()
+	messages := make(chan string, 1)
+	clientClosed := make(chan bool, 1)
+	c.OnTransport(func(t sylph.Transport) {
+		t.OnClose(func() {
+			clientClosed <- true
+		})
+		go func() {
+			ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+			if err != nil {
+				test.Error(err)
+				return
+			}
+			ch.OnMessage(func(m string) {
+				messages <- m
+			})
+		}()
+	})
+	if _, err := c.ConnectContext(context.Background(), "127.0.0.1:4456", testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case <-messages:
+	case <-time.After(time.Second * 3):
+		test.Fatal("message should be received")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		test.Fatal(err)
+	}
+
+	for _, ch := range []chan bool{serverClosed, clientClosed} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			test.Error("transport should be closed")
 		}
+	}
+	select {
+	case err := <-runErr:
+		if err != nil {
+			test.Error(err)
+		}
+	case <-time.After(time.Second):
+		test.Error("Run should return after Shutdown")
+	}
+}
+
+func TestShutdownDuringHandshake(test *testing.T) {
+	fmt.Println("TestShutdownDuringHandshake")
+	s := sylph.NewServer()
+	authenticating := make(chan bool, 1)
+	s.OnAuthenticate(func(ctx context.Context, payload []byte, remoteAddr net.Addr) error {
+		authenticating <- true
+		time.Sleep(time.Millisecond * 300)
+		return nil
+	})
+	connected := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		connected <- true
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	go c.ConnectContext(context.Background(), s.Addr().String(), testTransportConfig)
+	select {
+	case <-authenticating:
+	case <-time.After(time.Second * 3):
+		test.Fatal("OnAuthenticate should be called")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case <-connected:
+		test.Error("OnTransport should not be called after Shutdown")
+	case <-time.After(time.Millisecond * 500):
+	}
+	if count := s.TransportCount(); count != 0 {
+		test.Errorf("no transport should be registered after Shutdown, got %d", count)
+	}
+}
+
+func TestShutdownLegacyClient(test *testing.T) {
+	fmt.Println("TestShutdownLegacyClient")
+	s := sylph.NewServer()
+	connected := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		connected <- true
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	// Client of earlier releases, which sends no heartbeat until the reply and ignores GoingAway.
+	conn, err := dtls.Dial("udp", s.Addr().(*net.UDPAddr), &dtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	a, err := sctp.Client(sctp.Config{NetConn: conn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer a.Close()
+	st, err := a.OpenStream(0, sctp.PayloadTypeWebRTCBinary)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, err := st.Write(append([]byte{byte(engine.MessageTypeInitialize)}, `{"stream_type":0,"transport_id":""}`...)); err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case <-connected:
+	case <-time.After(time.Second * 3):
+		test.Fatal("legacy client should be connected")
+	}
 
-		if err := t.OpenChannel(); err != nil {
-			fmt.Println("open second channel erorr", err)
+	// Server closes the transport after GoingAway, without waiting for the Client.
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			test.Error(err)
 		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("Shutdown should return without the Client closing the transport")
+	}
+}
+
+func TestTransportRegistry(test *testing.T) {
+	fmt.Println("TestTransportRegistry")
+	s := sylph.NewServer()
+	defer s.Close()
+	serverClosed := make(chan bool, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnClose(func() {
+			serverClosed <- true
+		})
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
 	}
-	c.Connect("127.0.0.1", 4444)
 
+	ids := []string{}
+	for i := 0; i < 2; i++ {
+		c := sylph.NewClient()
+		defer c.Close()
+		t, err := c.ConnectContext(context.Background(), s.Addr().String(), testTransportConfig)
+		if err != nil {
+			test.Fatal(err)
+		}
+		ids = append(ids, strings.TrimSuffix(t.Id(), "-client"))
+	}
+
+	if count := s.TransportCount(); count != 2 {
+		test.Fatalf("transport count should be 2, got %d", count)
+	}
+	if transports := s.Transports(); len(transports) != 2 {
+		test.Fatalf("transports should have 2 transports, got %d", len(transports))
+	}
+	for _, id := range ids {
+		if t := s.Transport(id); t == nil || t.Id() != id {
+			test.Errorf("transport %s should be found", id)
+		}
+	}
+
+	s.Transport(ids[0]).Close()
+	select {
+	case <-serverClosed:
+	case <-time.After(time.Second * 3):
+		test.Fatal("transport should be closed")
+	}
+	if s.Transport(ids[0]) != nil {
+		test.Error("closed transport should be removed")
+	}
+	if count := s.TransportCount(); count != 1 {
+		test.Errorf("transport count should be 1, got %d", count)
+	}
+}
+
+func TestAdmissionControl(test *testing.T) {
+	fmt.Println("TestAdmissionControl")
+	configs := map[error]sylph.ServerConfig{
+		sylph.ErrTooManyTransports:     {MaxTransports: 1},
+		sylph.ErrHandshakeRateLimited:  {HandshakeRateLimit: sylph.RateLimit{Burst: 1, Interval: time.Hour}},
+		sylph.ErrConnectionRateLimited: {ConnectionRateLimit: sylph.RateLimit{Burst: 1, Interval: time.Hour}},
+	}
+	for expected, config := range configs {
+		s := sylph.NewServerWithConfig(config)
+		defer s.Close()
+		rejected := make(chan error, 8)
+		s.OnReject(func(remoteAddr net.Addr, err error) {
+			rejected <- err
+		})
+		if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+			test.Fatal(err)
+		}
+
+		tc := testTransportConfig
+		tc.HandshakeTimeout = time.Millisecond * 500
+		c := sylph.NewClient()
+		defer c.Close()
+		if _, err := c.ConnectContext(context.Background(), s.Addr().String(), tc); err != nil {
+			test.Fatal(err)
+		}
+
+		c = sylph.NewClient()
+		defer c.Close()
+		if _, err := c.ConnectContext(context.Background(), s.Addr().String(), tc); err == nil {
+			test.Errorf("connection should be refused with %v", expected)
+		}
+		select {
+		case err := <-rejected:
+			if err != expected {
+				test.Errorf("reject reason should be %v, got %v", expected, err)
+			}
+		default:
+			test.Errorf("OnReject should be called with %v", expected)
+		}
+	}
+}
+
+func TestMaxTransportsDuringHandshakes(test *testing.T) {
+	fmt.Println("TestMaxTransportsDuringHandshakes")
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{MaxTransports: 1})
+	defer s.Close()
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	// handshakes in progress are counted, so that concurrent Clients do not exceed MaxTransports.
+	tc := testTransportConfig
+	tc.HandshakeTimeout = time.Millisecond * 500
+	results := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			c := sylph.NewClient()
+			defer c.Close()
+			_, err := c.ConnectContext(context.Background(), s.Addr().String(), tc)
+			results <- err
+			time.Sleep(time.Second)
+		}()
+	}
+	connected := 0
+	for i := 0; i < 4; i++ {
+		if err := <-results; err == nil {
+			connected++
+		}
+	}
+	if connected != 1 {
+		test.Errorf("only one client should connect, got %d", connected)
+	}
+	if count := s.TransportCount(); count > 1 {
+		test.Errorf("transport count should not exceed 1, got %d", count)
+	}
+}
+
+func TestSilentClient(test *testing.T) {
+	fmt.Println("TestSilentClient")
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{MaxTransports: 1})
+	defer s.Close()
+	tc := testTransportConfig
+	tc.HandshakeTimeout = time.Millisecond * 500
+	if err := s.Listen("127.0.0.1", 0, tc); err != nil {
+		test.Fatal(err)
+	}
+
+	// the peer finishes dtls handshake and sctp association, and sends no initialize message.
+	conn, err := dtls.Dial("udp", s.Addr().(*net.UDPAddr), &dtls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	a, err := sctp.Client(sctp.Config{NetConn: conn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer a.Close()
+
+	// the silent peer is closed after HandshakeTimeout, and its reservation is released.
+	time.Sleep(time.Millisecond * 600)
+	c := sylph.NewClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), s.Addr().String(), tc); err != nil {
+		test.Fatalf("client should connect after the silent peer timed out, got %v", err)
+	}
+}
+
+// firstPacketConn writes only the first packet, and drops the others.
+type firstPacketConn struct {
+	net.Conn
+	lock    sync.Mutex
+	written bool
+}
+
+func (c *firstPacketConn) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.written {
+		return len(p), nil
+	}
+	c.written = true
+	return c.Conn.Write(p)
+}
+
+func TestIdleHandshake(test *testing.T) {
+	fmt.Println("TestIdleHandshake")
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{MaxPendingHandshakes: 1})
+	defer s.Close()
+	tc := testTransportConfig
+	tc.HandshakeTimeout = time.Millisecond * 300
+	if err := s.Listen("127.0.0.1", 0, tc); err != nil {
+		test.Fatal(err)
+	}
+
+	// the remote address starts dtls handshake and stays silent, it is removed after HandshakeTimeout.
+	conn, err := net.Dial("udp", s.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	go dtls.ClientWithContext(ctx, &firstPacketConn{Conn: conn}, &dtls.Config{InsecureSkipVerify: true})
+	time.Sleep(time.Millisecond * 500)
+
+	c := sylph.NewClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), s.Addr().String(), tc); err != nil {
+		test.Fatalf("client should connect after the idle handshake timed out, got %v", err)
+	}
+}
+
+func TestMultipleListeners(test *testing.T) {
+	fmt.Println("TestMultipleListeners")
+	certificate, err := selfsign.GenerateSelfSigned()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	s := sylph.NewServer()
+	defer s.Close()
+	transports := make(chan sylph.Transport, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		transports <- t
+	})
+	if err := s.ListenWithConfig(sylph.ListenConfig{Address: "127.0.0.1"}, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	if err := s.ListenWithConfig(sylph.ListenConfig{Address: "127.0.0.1", Certificate: &certificate}, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != 2 {
+		test.Fatalf("server should listen on 2 addresses, got %v", addrs)
+	}
+
+	// the certificate is used only for the second address.
+	tc := testTransportConfig
+	tc.CertificateFingerprint = sylph.Fingerprint(certificate)
+	tc.HandshakeTimeout = time.Millisecond * 500
+	c := sylph.NewClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), addrs[0].String(), tc); err == nil {
+		test.Error("certificate of the first address should not match")
+	}
+	c = sylph.NewClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), addrs[1].String(), tc); err != nil {
+		test.Fatal(err)
+	}
+	c = sylph.NewClient()
+	defer c.Close()
+	if _, err := c.ConnectContext(context.Background(), addrs[0].String(), testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-transports:
+		case <-time.After(time.Second * 3):
+			test.Fatal("transport should be passed to OnTransport")
+		}
+	}
+	if count := s.TransportCount(); count != 2 {
+		test.Errorf("transport count should be 2, got %d", count)
+	}
+}
+
+func TestPacketConn(test *testing.T) {
+	fmt.Println("TestPacketConn")
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer serverConn.Close()
+	clientConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	s := sylph.NewServer()
+	messages := make(chan string, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			c.OnMessage(func(m string) {
+				messages <- m
+			})
+		})
+	})
+	fallbackPackets := make(chan []byte, 2)
+	fallback := func(packet []byte, addr net.Addr) {
+		fallbackPackets <- packet
+	}
+	if err := s.ListenWithConfig(sylph.ListenConfig{PacketConn: serverConn, Fallback: fallback}, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	if s.Addr().String() != serverConn.LocalAddr().String() {
+		test.Errorf("server address should be %s, got %s", serverConn.LocalAddr(), s.Addr())
+	}
+
+	c := sylph.NewClientWithPacketConn(clientConn)
+	c.SetFallback(fallback)
+	t, err := c.ConnectContext(context.Background(), serverConn.LocalAddr().String(), testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if t.RemoteAddr().String() != serverConn.LocalAddr().String() {
+		test.Errorf("remote address should be %s, got %s", serverConn.LocalAddr(), t.RemoteAddr())
+	}
+	ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	ch.SendMessage("hello")
+	select {
+	case m := <-messages:
+		if m != "hello" {
+			test.Errorf("message should be hello, got %s", m)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("message should be received")
+	}
+
+	// packets other than dtls, e.g. STUN, are passed to the fallback of both sides.
+	for _, conn := range []net.PacketConn{serverConn, clientConn} {
+		serverConn.WriteTo([]byte{0, 1}, conn.LocalAddr())
+		select {
+		case packet := <-fallbackPackets:
+			if !bytes.Equal(packet, []byte{0, 1}) {
+				test.Errorf("fallback packet should be passed as is, got %v", packet)
+			}
+		case <-time.After(time.Second):
+			test.Error("packet other than dtls should be passed to the fallback")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	s.Shutdown(ctx)
+	c.Close()
+	time.Sleep(time.Millisecond * 100)
+
+	// injected connections are not closed, and can be read again.
+	for _, conn := range []net.PacketConn{serverConn, clientConn} {
+		if _, err := conn.WriteTo([]byte{0}, conn.LocalAddr()); err != nil {
+			test.Errorf("packet conn should not be closed: %v", err)
+		}
+		read := make(chan error, 1)
+		go func(conn net.PacketConn) {
+			_, _, err := conn.ReadFrom(make([]byte, 8))
+			read <- err
+		}(conn)
+		select {
+		case err := <-read:
+			if err != nil {
+				test.Errorf("read deadline should be cleared after closed: %v", err)
+			}
+		case <-time.After(time.Second):
+			test.Error("packet should be read after closed")
+		}
+	}
+}
+
+func TestReusePortWorkers(test *testing.T) {
+	fmt.Println("TestReusePortWorkers")
+	if runtime.GOOS != "linux" {
+		test.Skip("SO_REUSEPORT is supported only on Linux")
+	}
+
+	s := sylph.NewServerWithConfig(sylph.ServerConfig{ReusePortWorkers: 4})
+	defer s.Close()
+	transports := make(chan sylph.Transport, 8)
+	s.OnTransport(func(t sylph.Transport) {
+		transports <- t
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	addrs := s.Addrs()
+	if len(addrs) != 1 {
+		test.Fatalf("workers should share an address, got %v", addrs)
+	}
+
+	for i := 0; i < 8; i++ {
+		c := sylph.NewClient()
+		defer c.Close()
+		if _, err := c.ConnectContext(context.Background(), addrs[0].String(), testTransportConfig); err != nil {
+			test.Fatal(err)
+		}
+	}
+	for i := 0; i < 8; i++ {
+		select {
+		case <-transports:
+		case <-time.After(time.Second * 3):
+			test.Fatal("transport should be passed to OnTransport")
+		}
+	}
+	if count := s.TransportCount(); count != 8 {
+		test.Errorf("transport count should be 8, got %d", count)
+	}
+}
+
+func TestStreamIdAllocation(test *testing.T) {
+	fmt.Println("TestStreamIdAllocation")
+	s := sylph.NewServer()
+	defer s.Close()
+	openErr := make(chan error, 1)
+	channelIds := make(chan string, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			channelIds <- c.Id()
+		})
+		// the stream identifier of Server should not collide with the base stream of Client.
+		go func() {
+			_, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+			openErr <- err
+		}()
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+	select {
+	case err := <-openErr:
+		if err != nil {
+			test.Fatal("server should open a channel:", err)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("transport should be passed to OnTransport")
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := t.OpenChannel(context.Background(), channel.ChannelConfig{}); err != nil {
+			test.Fatal(err)
+		}
+	}
+	identifiers := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-channelIds:
+			identifiers[id[strings.LastIndex(id, "-")+1:]] = true
+		case <-time.After(time.Second * 3):
+			test.Fatal("channel should be passed to OnChannel")
+		}
+	}
+	// 0 is the base stream of Client.
+	if !identifiers["2"] || !identifiers["4"] {
+		test.Errorf("channels of client should have even stream identifiers 2 and 4, got %v", identifiers)
+	}
+}
+
+func TestChannelLabel(test *testing.T) {
+	fmt.Println("TestChannelLabel")
+	s := sylph.NewServer()
+	defer s.Close()
+	serverChannels := make(chan channel.Channel, 2)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			serverChannels <- c
+		})
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+	clientChannels := make(chan channel.Channel, 3)
+	for _, config := range []channel.ChannelConfig{{Label: "chat", Protocol: "json"}, {Label: "position-updates"}} {
+		ch, err := t.OpenChannel(context.Background(), config)
+		if err != nil {
+			test.Fatal(err)
+		}
+		clientChannels <- ch
+	}
+
+	for _, channels := range []chan channel.Channel{serverChannels, clientChannels} {
+		protocols := map[string]string{}
+		for i := 0; i < 2; i++ {
+			select {
+			case c := <-channels:
+				protocols[c.Label()] = c.Protocol()
+			case <-time.After(time.Second * 3):
+				test.Fatal("channel should be passed to OnChannel")
+			}
+		}
+		if protocol, exists := protocols["chat"]; !exists || protocol != "json" {
+			test.Errorf("chat channel should have protocol json, got %v", protocols)
+		}
+		if protocol, exists := protocols["position-updates"]; !exists || protocol != "" {
+			test.Errorf("position-updates channel should have no protocol, got %v", protocols)
+		}
+	}
+}
+
+func TestDCEP(test *testing.T) {
+	fmt.Println("TestDCEP")
+	tc := testTransportConfig
+	tc.DCEP = true
+
+	s := sylph.NewServer()
+	defer s.Close()
+	serverChannels := make(chan channel.Channel, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			c.OnMessage(func(message string) {
+				c.SendMessage("echo " + message)
+			})
+			c.OnData(func(data []byte) {
+				c.SendData(append([]byte("echo "), data...))
+			})
+			serverChannels <- c
+		})
+	})
+	if err := s.Listen("127.0.0.1", 0, tc); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), tc)
+	if err != nil {
+		test.Fatal(err)
+	}
+	config := channel.ChannelConfig{
+		Unordered:        true,
+		ReliabliityType:  channel.ReliabilityTypeRexmit,
+		ReliabilityValue: 3,
+		Label:            "chat",
+		Protocol:         "json",
+	}
+	ch, err := t.OpenChannel(context.Background(), config)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if ch.State() != channel.ChannelStateOpen {
+		test.Errorf("channel should be open after DATA_CHANNEL_ACK, got %s", ch.State())
+	}
+
+	select {
+	case ch := <-serverChannels:
+		if ch.Label() != "chat" || ch.Protocol() != "json" {
+			test.Errorf("label and protocol should be sent in DATA_CHANNEL_OPEN, got %s %s", ch.Label(), ch.Protocol())
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be passed to OnChannel of server")
+	}
+
+	messages := make(chan string, 1)
+	ch.OnMessage(func(message string) {
+		messages <- message
+	})
+	data := make(chan []byte, 1)
+	ch.OnData(func(d []byte) {
+		data <- d
+	})
+
+	ch.SendMessage("hello")
+	select {
+	case message := <-messages:
+		if message != "echo hello" {
+			test.Errorf("message should be echoed, got %q", message)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("message should be echoed")
+	}
+	ch.SendData([]byte{1, 2, 3})
+	select {
+	case d := <-data:
+		if !bytes.Equal(d, []byte("echo \x01\x02\x03")) {
+			test.Errorf("data should be echoed, got %v", d)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("data should be echoed")
+	}
+	large := bytes.Repeat([]byte{4}, 4096)
+	ch.SendData(large)
+	select {
+	case d := <-data:
+		if !bytes.Equal(d, append([]byte("echo "), large...)) {
+			test.Errorf("large data should be echoed, got %v bytes", len(d))
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("large data should be echoed")
+	}
+}
+
+func TestOpenChannel(test *testing.T) {
+	fmt.Println("TestOpenChannel")
+	s := sylph.NewServer()
+	defer s.Close()
+	serverChannels := make(chan channel.Channel, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			// sent just after the channel opened, before the opener sets OnMessage.
+			c.SendMessage("welcome")
+		})
+		// Client accepts the channel opened in OnTransport.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		defer cancel()
+		c, err := t.OpenChannel(ctx, channel.ChannelConfig{Label: "from server"})
+		if err != nil {
+			test.Error(err)
+			return
+		}
+		serverChannels <- c
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	clientChannels := make(chan channel.Channel, 1)
+	c.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			clientChannels <- c
+		})
+	})
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	// a channel opened by Server is passed to OnChannel of Client.
+	select {
+	case ch := <-clientChannels:
+		if ch.Label() != "from server" || ch.State() != channel.ChannelStateOpen {
+			test.Errorf("channel of server should be open, got %s %s", ch.Label(), ch.State())
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel of server should be passed to OnChannel")
+	}
+	select {
+	case <-serverChannels:
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel of server should be acknowledged")
+	}
+
+	ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	if ch.State() != channel.ChannelStateOpen {
+		test.Errorf("channel should be open, got %s", ch.State())
+	}
+	messages := make(chan string, 1)
+	ch.OnMessage(func(m string) {
+		// handlers can use the channel.
+		ch.OnData(func(d []byte) {})
+		messages <- m
+	})
+	select {
+	case m := <-messages:
+		if m != "welcome" {
+			test.Errorf("message should be welcome, got %s", m)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("message sent before OnMessage should be received")
+	}
+
+	ch.Close()
+	for i := 0; ch.State() != channel.ChannelStateClosed; i++ {
+		if i > 100 {
+			test.Fatalf("channel should be closed, got %s", ch.State())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := t.OpenChannel(ctx, channel.ChannelConfig{}); !errors.Is(err, context.Canceled) {
+		test.Errorf("OpenChannel should return error of ctx, got %v", err)
+	}
+}
+
+func TestHeartbeatTimeout(test *testing.T) {
+	fmt.Println("TestHeartbeatTimeout")
+	s := sylph.NewServer()
+	defer s.Close()
+	serverTransports := make(chan sylph.Transport, 1)
+	serverClosed := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnClose(func() {
+			serverClosed <- true
+		})
+		serverTransports <- t
+	})
+	if err := s.Listen("127.0.0.1", 0, testTransportConfig); err != nil {
+		test.Fatal(err)
+	}
+	proxy := newUDPProxy(test, s.Addr().(*net.UDPAddr).Port)
+	defer proxy.close()
+
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), fmt.Sprintf("127.0.0.1:%d", proxy.port()), testTransportConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+	clientClosed := make(chan bool, 1)
+	t.OnClose(func() {
+		clientClosed <- true
+	})
+	channels := []channel.Channel{}
+	for i := 0; i < 3; i++ {
+		ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+		if err != nil {
+			test.Fatal(err)
+		}
+		channels = append(channels, ch)
+	}
+	serverTransport := <-serverTransports
+
+	// wait for heartbeat to start health check.
+	time.Sleep(time.Millisecond * 1500)
+	proxy.setBlocked(true)
+
+	for _, closed := range []chan bool{clientClosed, serverClosed} {
+		select {
+		case <-closed:
+		case <-time.After(time.Second * 5):
+			test.Fatal("transport should be closed by heartbeat timeout")
+		}
+	}
+	for _, transport := range []sylph.Transport{t, serverTransport} {
+		if err := transport.Err(); !errors.Is(err, sylph.ErrHeartbeatTimeout) {
+			test.Errorf("transport should be closed with ErrHeartbeatTimeout, got %v", err)
+		}
+	}
+	for _, ch := range channels {
+		for i := 0; ch.State() != channel.ChannelStateClosed; i++ {
+			if i > 100 {
+				test.Fatalf("channel should be closed with the transport, got %s", ch.State())
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestLargeMessage(test *testing.T) {
+	fmt.Println("TestLargeMessage")
+	tc := testTransportConfig
+	tc.MaxMessageSize = 256 * 1024
+
+	s := sylph.NewServer()
+	defer s.Close()
+	s.OnTransport(func(t sylph.Transport) {
+		t.OnChannel(func(c channel.Channel) {
+			c.OnMessage(func(message string) {
+				c.SendMessage(message)
+			})
+			c.OnData(func(data []byte) {
+				c.SendData(data)
+			})
+		})
+	})
+	if err := s.Listen("127.0.0.1", 0, tc); err != nil {
+		test.Fatal(err)
+	}
+
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), tc)
+	if err != nil {
+		test.Fatal(err)
+	}
+	ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{Unordered: true})
+	if err != nil {
+		test.Fatal(err)
+	}
+	messages := make(chan string, 1)
+	ch.OnMessage(func(message string) {
+		messages <- message
+	})
+	data := make(chan []byte, 1)
+	ch.OnData(func(d []byte) {
+		data <- d
+	})
+
+	sent := make([]byte, tc.MaxMessageSize)
+	for i := range sent {
+		sent[i] = byte(i % 251)
+	}
+	if n, err := ch.SendData(sent); err != nil || n != len(sent) {
+		test.Fatalf("large data should be sent, got %v, %v", n, err)
+	}
+	select {
+	case d := <-data:
+		if !bytes.Equal(d, sent) {
+			test.Errorf("large data should be reassembled, got %v bytes", len(d))
+		}
+	case <-time.After(time.Second * 5):
+		test.Fatal("large data should be echoed")
+	}
+
+	message := strings.Repeat("sylph", 1000)
+	ch.SendMessage(message)
+	select {
+	case m := <-messages:
+		if m != message {
+			test.Errorf("large message should be reassembled, got %v bytes", len(m))
+		}
+	case <-time.After(time.Second * 5):
+		test.Fatal("large message should be echoed")
+	}
+
+	// messages fitting in a frame are read into a reused buffer, and must not share it.
+	frames := [][]byte{bytes.Repeat([]byte{1}, 60000), bytes.Repeat([]byte{2}, 60000)}
+	for _, f := range frames {
+		ch.SendData(f)
+	}
+	for _, f := range frames {
+		select {
+		case d := <-data:
+			if !bytes.Equal(d, f) {
+				test.Errorf("data in a frame should be kept, got %v bytes", len(d))
+			}
+		case <-time.After(time.Second * 5):
+			test.Fatal("data in a frame should be echoed")
+		}
+	}
+
+	_, err = ch.SendData(make([]byte, tc.MaxMessageSize+1))
+	var tooLarge *sylph.MessageTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.MaxMessageSize != tc.MaxMessageSize {
+		test.Errorf("data over max message size should return MessageTooLargeError, got %v", err)
+	}
+
+	if _, err := t.OpenChannel(context.Background(), channel.ChannelConfig{Label: strings.Repeat("l", 65536)}); !errors.Is(err, sylph.ErrFieldTooLarge) {
+		test.Errorf("label over 65535 bytes should return ErrFieldTooLarge, got %v", err)
+	}
+}
+
+func TestLegacyProtocol(test *testing.T) {
+	fmt.Println("TestLegacyProtocol")
+	clientConn, serverConn := net.Pipe()
+	server := transport.NewSctpTransport("server")
+	server.OnTransportInitialized = func() {}
+	go func() {
+		if err := server.Init(serverConn, false, engine.EngineConfig{HeartbeatRateMillisec: 100, TimeOutDurationMilliSec: 1000}); err == nil {
+			server.AcceptStreamLoop()
+		}
+	}()
+	defer server.Close()
+
+	// Client of earlier releases, sending frames without header and the initialize message in JSON.
+	a, err := sctp.Client(sctp.Config{NetConn: clientConn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer a.Close()
+	st, err := a.OpenStream(0, sctp.PayloadTypeWebRTCBinary)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, err := st.Write(append([]byte{byte(engine.MessageTypeInitialize)}, `{"stream_type":0,"transport_id":""}`...)); err != nil {
+		test.Fatal(err)
+	}
+
+	replied := make(chan []byte, 1)
+	go func() {
+		for {
+			buffer := make([]byte, 1024)
+			l, err := st.Read(buffer)
+			if err != nil {
+				return
+			}
+			if buffer[0] == byte(engine.MessageTypeInitialize) {
+				replied <- buffer[:l]
+				return
+			}
+		}
+	}()
+	select {
+	case frame := <-replied:
+		var reply engine.InitializeMessage
+		if err := json.Unmarshal(frame[1:], &reply); err != nil || reply.TransportId != "server" || reply.Error != "" {
+			test.Errorf("server should reply in JSON to legacy client, got %q", frame)
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("server should reply to legacy client")
+	}
+}
+
+// dcepOpen builds DATA_CHANNEL_OPEN of a reliable and ordered channel, as WebRTC peers send.
+func dcepOpen(label string) []byte {
+	message := []byte{0x03, 0x00, 0, 0, 0, 0, 0, 0, byte(len(label) >> 8), byte(len(label)), 0, 0}
+	return append(message, label...)
+}
+
+func TestDCEPPeer(test *testing.T) {
+	fmt.Println("TestDCEPPeer")
+	config := engine.EngineConfig{HeartbeatRateMillisec: 100, TimeOutDurationMilliSec: 1000}
+
+	// WebRTC peer opening stream 0 with DCEP, without the transport handshake of sylph.
+	clientConn, serverConn := net.Pipe()
+	server := transport.NewSctpTransport("server")
+	server.DCEP = true
+	channels := make(chan channel.Channel, 1)
+	server.OnChannel(func(c channel.Channel) {
+		c.OnMessage(func(message string) {
+			c.SendMessage("echo " + message)
+		})
+		channels <- c
+	})
+	go func() {
+		if err := server.Init(serverConn, false, config); err == nil {
+			server.AcceptStreamLoop()
+		}
+	}()
+	defer server.Close()
+
+	a, err := sctp.Client(sctp.Config{NetConn: clientConn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer a.Close()
+	st, err := a.OpenStream(0, sctp.PayloadTypeWebRTCDCEP)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if _, err := st.WriteSCTP(dcepOpen("webrtc"), sctp.PayloadTypeWebRTCDCEP); err != nil {
+		test.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	l, ppi, err := st.ReadSCTP(buffer)
+	if err != nil || ppi != sctp.PayloadTypeWebRTCDCEP || !bytes.Equal(buffer[:l], []byte{0x02}) {
+		test.Fatalf("DATA_CHANNEL_OPEN on stream 0 should be acked, got %v %v %v", buffer[:l], ppi, err)
+	}
+	select {
+	case c := <-channels:
+		if c.Label() != "webrtc" {
+			test.Errorf("label should be sent in DATA_CHANNEL_OPEN, got %s", c.Label())
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be passed to OnChannel")
+	}
+	st.WriteSCTP([]byte("hello"), sctp.PayloadTypeWebRTCString)
+	l, ppi, err = st.ReadSCTP(buffer)
+	if err != nil || ppi != sctp.PayloadTypeWebRTCString || string(buffer[:l]) != "echo hello" {
+		test.Errorf("message should be echoed without framing, got %q %v %v", buffer[:l], ppi, err)
+	}
+
+	// WebRTC peer accepting the channel opened by Client.
+	clientConn, serverConn = net.Pipe()
+	client := transport.NewSctpTransport("client")
+	client.DCEP = true
+	initialized := make(chan bool, 1)
+	client.OnTransportInitialized = func() {
+		initialized <- true
+		go client.AcceptStreamLoop()
+	}
+	go client.Init(clientConn, true, config)
+	defer client.Close()
+
+	peer, err := sctp.Server(sctp.Config{NetConn: serverConn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer peer.Close()
+	select {
+	case <-initialized:
+	case <-time.After(time.Second * 3):
+		test.Fatal("client should be initialized without the reply of the transport handshake")
+	}
+	opened := make(chan channel.Channel, 1)
+	go func() {
+		c, err := client.OpenChannel(context.Background(), channel.ChannelConfig{Label: "sylph"})
+		if err != nil {
+			test.Error(err)
+			return
+		}
+		opened <- c
+	}()
+	st, err = peer.AcceptStream()
+	if err != nil {
+		test.Fatal(err)
+	}
+	l, ppi, err = st.ReadSCTP(buffer)
+	if err != nil || ppi != sctp.PayloadTypeWebRTCDCEP || buffer[0] != 0x03 || st.StreamIdentifier() != 0 {
+		test.Fatalf("client should open stream 0 with DATA_CHANNEL_OPEN, got %v %v %v on %d", buffer[:l], ppi, err, st.StreamIdentifier())
+	}
+	st.WriteSCTP([]byte{0x02}, sctp.PayloadTypeWebRTCDCEP)
+	select {
+	case c := <-opened:
+		if c.State() != channel.ChannelStateOpen {
+			test.Errorf("channel should be open after DATA_CHANNEL_ACK, got %s", c.State())
+		}
+	case <-time.After(time.Second * 3):
+		test.Fatal("channel should be opened by the peer")
+	}
+}
+
+func TestLegacyServer(test *testing.T) {
+	fmt.Println("TestLegacyServer")
+	clientConn, serverConn := net.Pipe()
+	client := transport.NewSctpTransport("")
+	initialized := make(chan bool, 1)
+	client.OnTransportInitialized = func() {
+		initialized <- true
+	}
+	go func() {
+		if err := client.Init(clientConn, true, engine.EngineConfig{HeartbeatRateMillisec: 100, TimeOutDurationMilliSec: 1000}); err == nil {
+			client.AcceptStreamLoop()
+		}
+	}()
+	defer client.Close()
+
+	// Server of earlier releases, sending its initialize message in JSON when the base stream is accepted.
+	a, err := sctp.Server(sctp.Config{NetConn: serverConn, LoggerFactory: logging.NewDefaultLoggerFactory()})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer a.Close()
+	st, err := a.AcceptStream()
+	if err != nil {
+		test.Fatal(err)
+	}
+	buffer := make([]byte, 1024)
+	l, err := st.Read(buffer)
+	if err != nil {
+		test.Fatal(err)
+	}
+	var message engine.InitializeMessage
+	if buffer[0] != byte(engine.MessageTypeInitialize) || json.Unmarshal(buffer[1:l], &message) != nil || message.Version != engine.ProtocolVersion {
+		test.Fatalf("client should send the initialize message in JSON with its version, got %q", buffer[:l])
+	}
+	if _, err := st.Write(append([]byte{byte(engine.MessageTypeInitialize)}, `{"stream_type":2,"transport_id":"legacy"}`...)); err != nil {
+		test.Fatal(err)
+	}
+
+	select {
+	case <-initialized:
+	case <-time.After(time.Second * 3):
+		test.Fatal("client should accept legacy server")
+	}
+	if _, version := client.NegotiatedConfig(); version != engine.ProtocolVersionLegacy || client.Id() != "legacy-client" {
+		test.Errorf("client should use version 0 with legacy server, got %d, %s", version, client.Id())
+	}
+}
+
+func TestProtocolMismatch(test *testing.T) {
+	fmt.Println("TestProtocolMismatch")
+	tc := testTransportConfig
+	tc.HandshakeTimeout = time.Millisecond * 300
+	dcep := tc
+	dcep.DCEP = true
+
+	// Client in DCEP mode sends no transport handshake, and Server without DCEP closes it.
+	s := sylph.NewServer()
+	defer s.Close()
+	connected := make(chan bool, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		connected <- true
+	})
+	if err := s.Listen("127.0.0.1", 0, tc); err != nil {
+		test.Fatal(err)
+	}
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), dcep)
+	if err != nil {
+		test.Fatal(err)
+	}
+	for i := 0; !t.IsClosed(); i++ {
+		if i > 100 {
+			test.Fatal("server without DCEP should close the client in DCEP mode")
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+	select {
+	case <-connected:
+		test.Error("OnTransport should not be called for the client in DCEP mode")
+	default:
+	}
+
+	// Server in DCEP mode does not reply to the transport handshake.
+	dcepServer := sylph.NewServer()
+	defer dcepServer.Close()
+	if err := dcepServer.Listen("127.0.0.1", 0, dcep); err != nil {
+		test.Fatal(err)
+	}
+	c2 := sylph.NewClient()
+	defer c2.Close()
+	if _, err := c2.ConnectContext(context.Background(), dcepServer.Addr().String(), tc); !errors.Is(err, sylph.ErrHandshakeTimeout) {
+		test.Errorf("client without DCEP should time out with server in DCEP mode, got %v", err)
+	}
+}
+
+func TestNegotiatedConfig(test *testing.T) {
+	fmt.Println("TestNegotiatedConfig")
+	serverConfig := testTransportConfig
+	serverConfig.HeartbeatRateMillisec = 100
+	serverConfig.TimeOutDurationMilliSec = 300
+	serverConfig.MaxMessageSize = 64 * 1024
+
+	s := sylph.NewServer()
+	defer s.Close()
+	serverTransports := make(chan sylph.Transport, 1)
+	s.OnTransport(func(t sylph.Transport) {
+		serverTransports <- t
+	})
+	if err := s.Listen("127.0.0.1", 0, serverConfig); err != nil {
+		test.Fatal(err)
+	}
+
+	// heartbeat of Client is slower than the timeout of Server, without negotiation.
+	clientConfig := testTransportConfig
+	clientConfig.HeartbeatRateMillisec = 500
+	clientConfig.TimeOutDurationMilliSec = 5000
+	c := sylph.NewClient()
+	defer c.Close()
+	t, err := c.ConnectContext(context.Background(), s.Addr().String(), clientConfig)
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	expected := sylph.NegotiatedConfig{
+		HeartbeatRateMillisec:   100,
+		TimeOutDurationMilliSec: 300,
+		MaxMessageSize:          64 * 1024,
+		ProtocolVersion:         1,
+	}
+	if config := t.NegotiatedConfig(); config != expected {
+		test.Errorf("client should adopt config of server, got %+v", config)
+	}
+	var st sylph.Transport
+	select {
+	case st = <-serverTransports:
+	case <-time.After(time.Second * 3):
+		test.Fatal("server should pass the transport to OnTransport")
+	}
+	if config := st.NegotiatedConfig(); config != expected {
+		test.Errorf("server should keep its heartbeat and the smaller max message size, got %+v", config)
+	}
+
+	time.Sleep(time.Millisecond * 1500)
+	if t.IsClosed() || st.IsClosed() {
+		test.Error("transport should not time out with the negotiated heartbeat")
+	}
+
+	ch, err := t.OpenChannel(context.Background(), channel.ChannelConfig{})
+	if err != nil {
+		test.Fatal(err)
+	}
+	_, err = ch.SendData(make([]byte, 64*1024+1))
+	var tooLarge *sylph.MessageTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.MaxMessageSize != 64*1024 {
+		test.Errorf("data over the negotiated max message size should return MessageTooLargeError, got %v", err)
+	}
 }
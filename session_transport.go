@@ -0,0 +1,187 @@
+package sylph
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"sync"
+
+	"github.com/tkmn0/sylph/internal/transport"
+	"github.com/tkmn0/sylph/pkg/channel"
+)
+
+// maxPendingChannels is the maximum number of Channels kept until OnChannel is set.
+const maxPendingChannels = 256
+
+// sessionTransport is Transport passed to OnTransport of Client and Server.
+// When Client reconnected or resumed, the underlying SctpTransport is replaced,
+// and handlers are kept over the replacement.
+// While suspended, closing the underlying SctpTransport does not call OnClose.
+// Channels opened by the other side before OnChannel is set are passed to it when set.
+type sessionTransport struct {
+	lock             sync.RWMutex
+	current          *transport.SctpTransport
+	suspended        bool
+	onChannelHandler func(c channel.Channel)
+	pendingChannels  []channel.Channel
+	notifying        bool
+	onCloseHandler   func()
+	onReleased       func()
+}
+
+func newSessionTransport() *sessionTransport {
+	return &sessionTransport{}
+}
+
+// attach replaces the underlying SctpTransport.
+func (t *sessionTransport) attach(st *transport.SctpTransport) {
+	t.lock.Lock()
+	t.current = st
+	t.lock.Unlock()
+
+	st.OnChannel(t.notifyChannel)
+	st.OnClose(func() {
+		// a replaced transport closes after reconnected, it must not close this.
+		if t.transport() == st {
+			t.onTransportClosed()
+		}
+	})
+}
+
+func (t *sessionTransport) transport() *transport.SctpTransport {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.current
+}
+
+func (t *sessionTransport) notifyChannel(c channel.Channel) {
+	t.lock.Lock()
+	if len(t.pendingChannels) < maxPendingChannels {
+		t.pendingChannels = append(t.pendingChannels, c)
+	}
+	t.flushChannels()
+}
+
+// flushChannels passes pending Channels to OnChannel in order, calling it without the lock,
+// so that the handler can use the Transport. This is called with the lock held, and releases it.
+func (t *sessionTransport) flushChannels() {
+	defer t.lock.Unlock()
+	if t.notifying {
+		// the goroutine notifying passes them.
+		return
+	}
+	t.notifying = true
+	for len(t.pendingChannels) > 0 && t.onChannelHandler != nil {
+		c, handler := t.pendingChannels[0], t.onChannelHandler
+		t.pendingChannels = t.pendingChannels[1:]
+		t.lock.Unlock()
+		handler(c)
+		t.lock.Lock()
+	}
+	t.notifying = false
+}
+
+func (t *sessionTransport) setSuspended(suspended bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.suspended = suspended
+}
+
+func (t *sessionTransport) IsSuspended() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return t.suspended
+}
+
+// onTransportClosed is called when the underlying SctpTransport closed.
+// OnClose is not called while suspended.
+func (t *sessionTransport) onTransportClosed() {
+	t.lock.RLock()
+	suspended := t.suspended
+	onCloseHandler := t.onCloseHandler
+	onReleased := t.onReleased
+	t.lock.RUnlock()
+
+	if suspended {
+		return
+	}
+	if onReleased != nil {
+		onReleased()
+	}
+	if onCloseHandler != nil {
+		onCloseHandler()
+	}
+}
+
+// notifyClosed calls OnClose when reconnecting or resumption was given up.
+func (t *sessionTransport) notifyClosed() {
+	t.setSuspended(false)
+	t.onTransportClosed()
+}
+
+// bufferedAmount returns the number of bytes not delivered to the other side yet.
+func (t *sessionTransport) bufferedAmount() uint64 {
+	return t.transport().BufferedAmount()
+}
+
+// goAway notifies the other side that this side is shutting down.
+func (t *sessionTransport) goAway() {
+	t.transport().GoAway()
+}
+
+func (t *sessionTransport) Err() error {
+	return t.transport().Err()
+}
+
+func (t *sessionTransport) OpenChannel(ctx context.Context, config channel.ChannelConfig) (channel.Channel, error) {
+	return t.transport().OpenChannel(ctx, config)
+}
+
+func (t *sessionTransport) OnChannel(handler func(channel channel.Channel)) {
+	t.lock.Lock()
+	t.onChannelHandler = handler
+	t.flushChannels()
+}
+
+func (t *sessionTransport) OnClose(handler func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.onCloseHandler = handler
+}
+
+func (t *sessionTransport) Close() {
+	t.setSuspended(false)
+	t.transport().Close()
+}
+
+func (t *sessionTransport) Id() string {
+	return t.transport().Id()
+}
+
+func (t *sessionTransport) Channel(id string) channel.Channel {
+	return t.transport().Channel(id)
+}
+
+func (t *sessionTransport) SetConfig() {}
+
+func (t *sessionTransport) NegotiatedConfig() NegotiatedConfig {
+	config, version := t.transport().NegotiatedConfig()
+	return NegotiatedConfig{
+		HeartbeatRateMillisec:   config.HeartbeatRateMillisec,
+		TimeOutDurationMilliSec: config.TimeOutDurationMilliSec,
+		MaxMessageSize:          config.MaxMessageSize,
+		ProtocolVersion:         version,
+	}
+}
+
+func (t *sessionTransport) IsClosed() bool {
+	return !t.IsSuspended() && t.transport().IsClosed()
+}
+
+func (t *sessionTransport) RemoteAddr() net.Addr {
+	return t.transport().RemoteAddr()
+}
+
+func (t *sessionTransport) PeerCertificates() ([]*x509.Certificate, error) {
+	return t.transport().PeerCertificates()
+}
@@ -1,14 +1,54 @@
 package sylph
 
 import (
+	"context"
+	"crypto/x509"
+	"net"
+
+	"github.com/tkmn0/sylph/internal/engine"
+	"github.com/tkmn0/sylph/internal/transport"
 	"github.com/tkmn0/sylph/pkg/channel"
 )
 
+// ErrStreamIdExhausted is returned by OpenChannel when no more channels can be opened by this side.
+// Client opens channels with even sctp stream identifiers and Server opens them with odd ones,
+// and identifiers of closed channels are reused.
+var ErrStreamIdExhausted = transport.ErrStreamIdExhausted
+
+// ErrHeartbeatTimeout is returned by Transport.Err when heartbeat from the other side timed out.
+// Heartbeat is sent only on the base stream of a Transport, and the timeout closes the whole Transport.
+var ErrHeartbeatTimeout = transport.ErrHeartbeatTimeout
+
+// ErrChannelClosed is returned by OpenChannel when the Channel or the Transport is closed
+// before the other side acknowledged the Channel.
+var ErrChannelClosed = transport.ErrChannelClosed
+
+// ErrFieldTooLarge is returned by OpenChannel when the label or the protocol is over 65535 bytes,
+// and by ConnectContext wrapped in *AssociationError when TransportConfig.AuthPayload is.
+var ErrFieldTooLarge = engine.ErrFieldTooLarge
+
+// MessageTooLargeError is returned by Channel.SendData and SendMessage
+// when the message exceeds TransportConfig.MaxMessageSize.
+// It is passed to Channel.OnError as well, when a received message exceeds it.
+type MessageTooLargeError = engine.MessageTooLargeError
+
 // Transport is interface for transport.
 // Transport handles Channels.
 // A Transport handles a bundle of Channels.
+// RemoteAddr and PeerCertificates identify the other side.
+// PeerCertificates is empty when the other side presented no certificate,
+// and returns the error when a presented certificate could not be parsed.
+// IsSuspended reports the Transport is waiting for reconnection or resumption of the other side.
+// Err returns the reason the Transport closed or suspended, ErrHeartbeatTimeout when heartbeat timed out,
+// or the error of the connection when it failed.
+// NegotiatedConfig returns the config negotiated with the other side in the transport handshake.
+//
+// OpenChannel returns the Channel after the other side acknowledged it, or the error of ctx.
+// This can be called in OnTransport of both sides.
+// OnChannel is called only for Channels opened by the other side, and Channels opened again by
+// either side after reconnection. Channels opened before OnChannel is set are passed to it when set.
 type Transport interface {
-	OpenChannel(config channel.ChannelConfig) error
+	OpenChannel(ctx context.Context, config channel.ChannelConfig) (channel.Channel, error)
 	OnChannel(handler func(channel channel.Channel))
 	OnClose(handler func())
 	Close()
@@ -16,4 +56,9 @@ type Transport interface {
 	Channel(id string) channel.Channel
 	SetConfig()
 	IsClosed() bool
+	IsSuspended() bool
+	Err() error
+	NegotiatedConfig() NegotiatedConfig
+	RemoteAddr() net.Addr
+	PeerCertificates() ([]*x509.Certificate, error)
 }